@@ -0,0 +1,225 @@
+// Package client talks to the manager API over HTTP.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Yuya9786/cube/manager"
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+// Client sends requests to the manager at Endpoint, e.g.
+// http://localhost:5555.
+type Client struct {
+	Endpoint string
+	HTTP     *http.Client
+}
+
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		HTTP:     http.DefaultClient,
+	}
+}
+
+// Error is an error response from the manager.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("manager responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return e.Message
+}
+
+func (c *Client) do(method string, path string, body any, out any) error {
+	resp, err := c.send(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("Error decoding response: %w", err)
+	}
+	return nil
+}
+
+// send makes a request and turns error responses into an *Error. On success
+// the caller has to close the response body.
+func (c *Client) send(method string, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.Endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// responseError reads an error response and closes its body.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := manager.ErrResponse{}
+	json.NewDecoder(resp.Body).Decode(&e)
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(e.Message),
+	}
+}
+
+// RunTask asks the manager to start t. A task without an ID is given one.
+func (c *Client) RunTask(t task.Task) (*task.Task, error) {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	te := task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     task.Start,
+		Timestatmp: time.Now(),
+		Task:       t,
+	}
+
+	created := &task.Task{}
+	if err := c.do(http.MethodPost, "/tasks", te, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *Client) GetTasks() ([]*task.Task, error) {
+	var tasks []*task.Task
+	if err := c.do(http.MethodGet, "/tasks", nil, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// GetTask returns a task along with the worker it was placed on.
+func (c *Client) GetTask(id uuid.UUID) (*manager.TaskRecord, error) {
+	record := &manager.TaskRecord{}
+	if err := c.do(http.MethodGet, fmt.Sprintf("/tasks/%s", id), nil, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (c *Client) StopTask(id uuid.UUID) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/tasks/%s", id), nil, nil)
+}
+
+// Logs returns the output of a task selected by opts. The caller has to
+// close it, which also ends a followed stream.
+func (c *Client) Logs(id uuid.UUID, opts task.LogOptions) (io.ReadCloser, error) {
+	path := fmt.Sprintf("/tasks/%s/logs", id)
+	if q := opts.Query().Encode(); q != "" {
+		path += "?" + q
+	}
+	resp, err := c.send(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Exec runs a command in a running task's container. The returned
+// connection carries the session as frames described by the task package;
+// the caller has to close it.
+func (c *Client) Exec(id uuid.UUID, config task.ExecConfig) (io.ReadWriteCloser, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint+fmt.Sprintf("/tasks/%s/exec", id), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", task.ExecUpgrade)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, responseError(resp)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Manager did not upgrade the connection")
+	}
+	return conn, nil
+}
+
+func (c *Client) GetNodes() ([]*node.Node, error) {
+	var nodes []*node.Node
+	if err := c.do(http.MethodGet, "/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (c *Client) GetEvents() ([]*task.TaskEvent, error) {
+	var events []*task.TaskEvent
+	if err := c.do(http.MethodGet, "/events", nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Apply makes the cluster match mf and returns what changed.
+func (c *Client) Apply(mf manager.Manifest) ([]manager.Change, error) {
+	return c.manifest("/manifest/apply", mf)
+}
+
+// Diff returns what applying mf would change.
+func (c *Client) Diff(mf manager.Manifest) ([]manager.Change, error) {
+	return c.manifest("/manifest/diff", mf)
+}
+
+// DeleteManifest removes the tasks and services mf defines.
+func (c *Client) DeleteManifest(mf manager.Manifest) ([]manager.Change, error) {
+	return c.manifest("/manifest/delete", mf)
+}
+
+func (c *Client) manifest(path string, mf manager.Manifest) ([]manager.Change, error) {
+	var changes []manager.Change
+	if err := c.do(http.MethodPost, path, mf, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
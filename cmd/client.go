@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+const defaultEndpoint = "http://localhost:5555"
+
+var errTaskNotFound = errors.New("task not found")
+
+// endpointFlag adds the -endpoint flag shared by the client commands. It
+// defaults to $CUBE_ENDPOINT, or the manager on localhost.
+func endpointFlag(fs *flag.FlagSet) *string {
+	endpoint := os.Getenv("CUBE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	return fs.String("endpoint", endpoint, "URL of the manager API (default $CUBE_ENDPOINT or "+defaultEndpoint+")")
+}
+
+func outputFlag(fs *flag.FlagSet, formats ...string) *string {
+	return fs.String("o", formats[0], "output format: "+strings.Join(formats, ", "))
+}
+
+func validateOutput(output string, formats ...string) error {
+	for _, f := range formats {
+		if output == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, expected one of %s", output, strings.Join(formats, ", "))
+}
+
+// fail prints err and returns the exit code for it: ExitNotFound when the
+// manager does not know what was asked for, ExitUnavailable when it cannot
+// be reached and ExitError otherwise.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+
+	var apiErr *client.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		return ExitNotFound
+	case errors.As(err, &apiErr) && apiErr.StatusCode == 404:
+		return ExitNotFound
+	case errors.As(err, &netErr):
+		return ExitUnavailable
+	}
+	return ExitError
+}
+
+// resolveTask finds the task a user refers to by its ID, a unique prefix of
+// its ID, or its name.
+func resolveTask(c *client.Client, ref string) (uuid.UUID, error) {
+	if id, err := uuid.Parse(ref); err == nil {
+		return id, nil
+	}
+
+	tasks, err := c.GetTasks()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return matchTask(tasks, ref)
+}
+
+// matchTask picks the task ref refers to. A name wins over an ID prefix.
+// Names need not be unique, e.g. a task that was replaced keeps its name,
+// so a name only refers to a finished task if no active task has it.
+func matchTask(tasks []*task.Task, ref string) (uuid.UUID, error) {
+	var named, active, matches []*task.Task
+	for _, t := range tasks {
+		if t.Name == ref {
+			named = append(named, t)
+			if !finished(t) {
+				active = append(active, t)
+			}
+		}
+		if strings.HasPrefix(t.ID.String(), ref) {
+			matches = append(matches, t)
+		}
+	}
+	if len(active) > 0 {
+		named = active
+	}
+	switch {
+	case len(named) == 1:
+		return named[0].ID, nil
+	case len(named) > 1:
+		return uuid.Nil, fmt.Errorf("ambiguous name %q matches %d tasks, use an ID", ref, len(named))
+	}
+
+	switch len(matches) {
+	case 0:
+		return uuid.Nil, fmt.Errorf("%w: %s", errTaskNotFound, ref)
+	case 1:
+		return matches[0].ID, nil
+	}
+	return uuid.Nil, fmt.Errorf("%q matches %d tasks, use a longer prefix", ref, len(matches))
+}
+
+func finished(t *task.Task) bool {
+	switch t.FSM.Current() {
+	case task.Completed, task.Failed:
+		return true
+	}
+	return false
+}
+
+func writeJSON(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+}
+
+func shortID(id uuid.UUID) string {
+	return id.String()[:12]
+}
+
+// age formats how long ago t was, or "-" for the zero time.
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+func newTask(name string, state string) *task.Task {
+	t := &task.Task{ID: uuid.New(), Name: name}
+	t.FSM = task.NewFSM()
+	t.FSM.SetState(state)
+	return t
+}
+
+func TestMatchTaskPrefersActive(t *testing.T) {
+	old := newTask("web", task.Completed)
+	failed := newTask("web", task.Failed)
+	running := newTask("web", task.Running)
+
+	for i := 0; i < 10; i++ {
+		id, err := matchTask([]*task.Task{old, running, failed}, "web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != running.ID {
+			t.Fatalf("matched %v, want the running task %v", id, running.ID)
+		}
+	}
+}
+
+func TestMatchTaskAmbiguousName(t *testing.T) {
+	tasks := []*task.Task{newTask("web", task.Running), newTask("web", task.Scheduled)}
+	if _, err := matchTask(tasks, "web"); err == nil {
+		t.Fatal("expected an error for two active tasks with the same name")
+	}
+
+	tasks = []*task.Task{newTask("web", task.Completed), newTask("web", task.Failed)}
+	if _, err := matchTask(tasks, "web"); err == nil {
+		t.Fatal("expected an error for two finished tasks with the same name")
+	}
+}
+
+func TestMatchTaskFinished(t *testing.T) {
+	done := newTask("batch", task.Completed)
+	id, err := matchTask([]*task.Task{done, newTask("web", task.Running)}, "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != done.ID {
+		t.Errorf("matched %v, want %v", id, done.ID)
+	}
+}
+
+func TestMatchTaskPrefix(t *testing.T) {
+	tk := newTask("web", task.Running)
+	id, err := matchTask([]*task.Task{tk, newTask("db", task.Running)}, tk.ID.String()[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != tk.ID {
+		t.Errorf("matched %v, want %v", id, tk.ID)
+	}
+
+	if _, err := matchTask([]*task.Task{tk}, "nothing"); !errors.Is(err, errTaskNotFound) {
+		t.Errorf("error is %v, want %v", err, errTaskNotFound)
+	}
+}
@@ -0,0 +1,119 @@
+// Package cmd implements the cube command line.
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Exit codes
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitUsage       = 2
+	ExitNotFound    = 3
+	ExitUnavailable = 4
+)
+
+type command struct {
+	Name    string
+	Summary string
+	Run     func(args []string) int
+}
+
+var commands = []command{
+	{Name: "manager", Summary: "Run a manager", Run: runManager},
+	{Name: "worker", Summary: "Run a worker", Run: runWorker},
+	{Name: "run", Summary: "Start a task", Run: runRun},
+	{Name: "ps", Summary: "List tasks", Run: runPs},
+	{Name: "ls", Summary: "List tasks (same as ps)", Run: runPs},
+	{Name: "stop", Summary: "Stop tasks", Run: runStop},
+	{Name: "inspect", Summary: "Show the details of tasks", Run: runInspect},
+	{Name: "logs", Summary: "Show the output of a task", Run: runLogs},
+	{Name: "exec", Summary: "Run a command in a running task", Run: runExec},
+	{Name: "nodes", Summary: "List worker nodes", Run: runNodes},
+	{Name: "events", Summary: "List task events", Run: runEvents},
+	{Name: "apply", Summary: "Make the cluster match manifests", Run: runApply},
+	{Name: "diff", Summary: "Show what applying manifests would change", Run: runDiff},
+	{Name: "delete", Summary: "Remove what manifests define", Run: runDelete},
+}
+
+// Execute runs the subcommand named by args[0] with the rest of args and
+// returns the exit code.
+func Execute(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return ExitUsage
+	}
+
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		usage(os.Stdout)
+		return ExitOK
+	}
+
+	for _, c := range commands {
+		if c.Name == args[0] {
+			return c.Run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage(os.Stderr)
+	return ExitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: cube <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'cube <command> -h' for the flags of a command.")
+}
+
+// newFlagSet returns the flag set of a command whose usage line is
+// "cube <synopsis>".
+func newFlagSet(name string, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cube "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cube %s\n\nFlags:\n", synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args with fs and turns parse errors into an exit code.
+// ok is false when the command should exit right away. Commands that take
+// positional arguments use parseArgs instead.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	return parseArgs(fs, args, 0, 0)
+}
+
+// parseArgs is parseFlags for commands that take between min and max
+// positional arguments; max < 0 means no limit.
+func parseArgs(fs *flag.FlagSet, args []string, min int, max int) (code int, ok bool) {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK, false
+		}
+		return ExitUsage, false
+	}
+	if fs.NArg() < min {
+		fmt.Fprintln(os.Stderr, "Not enough arguments")
+		fs.Usage()
+		return ExitUsage, false
+	}
+	if max >= 0 && fs.NArg() > max {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return ExitUsage, false
+	}
+	return ExitOK, true
+}
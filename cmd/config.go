@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configPath finds the value of the -config flag in args before the rest of
+// the flags are parsed, so that the file can provide their defaults.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return ""
+}
+
+// loadConfig reads the YAML file at path into v. Fields not present in the
+// file keep the values v already has; unknown fields are an error.
+func loadConfig(path string, v any) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file: %w", err)
+	}
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("Unable to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func validatePort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s must be between 1 and 65535, got %d", name, port)
+	}
+	return nil
+}
+
+func validateAddress(name string, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s %q must be of the form host:port", name, addr)
+	}
+	if host == "" {
+		return fmt.Errorf("%s %q has no host", name, addr)
+	}
+	var p int
+	if _, err := fmt.Sscanf(port, "%d", &p); err != nil {
+		return fmt.Errorf("%s %q has an invalid port", name, addr)
+	}
+	return validatePort(name+" port", p)
+}
+
+// joinErrors combines validation errors into one, one per line.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = "  " + err.Error()
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// stringList is a flag that can be given several times or as a comma
+// separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// overrideList is a stringList flag for a list that may also come from the
+// config file. Giving the flag replaces the file's list instead of adding
+// to it, as flags override the file.
+type overrideList struct {
+	list *[]string
+	set  bool
+}
+
+func (l *overrideList) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l *overrideList) Set(v string) error {
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	return (*stringList)(l.list).Set(v)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/task"
+)
+
+func runEvents(args []string) int {
+	fs := newFlagSet("events", "events [flags]")
+	endpoint := endpointFlag(fs)
+	output := outputFlag(fs, "table", "json")
+	ref := fs.String("task", "", "only show events of this task")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := validateOutput(*output, "table", "json"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	c := client.New(*endpoint)
+	events, err := c.GetEvents()
+	if err != nil {
+		return fail(err)
+	}
+	if *ref != "" {
+		id, err := resolveTask(c, *ref)
+		if err != nil {
+			return fail(err)
+		}
+		filtered := []*task.TaskEvent{}
+		for _, te := range events {
+			if te.Task.ID == id {
+				filtered = append(filtered, te)
+			}
+		}
+		events = filtered
+	}
+
+	if *output == "json" {
+		writeJSON(os.Stdout, events)
+		return ExitOK
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "TIME\tEVENT\tACTION\tTASK\tNAME")
+	for _, te := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			te.Timestatmp.Local().Format(time.RFC3339), shortID(te.ID), te.Action,
+			shortID(te.Task.ID), orDash(te.Task.Name))
+	}
+	tw.Flush()
+	return ExitOK
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/task"
+	"github.com/moby/term"
+)
+
+// runExec exits with the exit code of the command, as docker exec and
+// kubectl exec do. When cube itself fails, e.g. because the task is not
+// running, the error is reported on stderr and it exits with one of its own
+// codes.
+func runExec(args []string) int {
+	fs := newFlagSet("exec", "exec [flags] TASK [--] COMMAND [ARG...]")
+	endpoint := endpointFlag(fs)
+	interactive := fs.Bool("i", false, "pass stdin to the command")
+	tty := fs.Bool("t", false, "run the command on a terminal")
+	user := fs.String("user", "", "user to run the command as")
+	workdir := fs.String("workdir", "", "working directory of the command")
+	var env stringList
+	fs.Var(&env, "e", "KEY=VALUE environment variable; may be repeated")
+	if code, ok := parseArgs(fs, args, 2, -1); !ok {
+		return code
+	}
+	command := fs.Args()[1:]
+	if command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		fmt.Fprintln(os.Stderr, "No command given")
+		fs.Usage()
+		return ExitUsage
+	}
+
+	c := client.New(*endpoint)
+	id, err := resolveTask(c, fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	conn, err := c.Exec(id, task.ExecConfig{
+		Cmd:        command,
+		Env:        env,
+		User:       *user,
+		WorkingDir: *workdir,
+		Stdin:      *interactive,
+		Tty:        *tty,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+
+	mu := &sync.Mutex{}
+	fd := os.Stdin.Fd()
+	if *tty && term.IsTerminal(fd) {
+		state, err := term.SetRawTerminal(fd)
+		if err != nil {
+			return fail(err)
+		}
+		defer term.RestoreTerminal(fd, state)
+		go sendResizes(conn, mu, fd)
+	}
+	if *interactive {
+		go func() {
+			io.Copy(task.FrameWriter{W: conn, Kind: task.ExecStdin, Mu: mu}, os.Stdin)
+			mu.Lock()
+			task.WriteFrame(conn, task.ExecCloseStdin, nil)
+			mu.Unlock()
+		}()
+	}
+
+	for {
+		kind, payload, err := task.ReadFrame(conn)
+		if err != nil {
+			return fail(fmt.Errorf("Exec session ended unexpectedly: %w", err))
+		}
+		switch kind {
+		case task.ExecStdout:
+			os.Stdout.Write(payload)
+		case task.ExecStderr:
+			os.Stderr.Write(payload)
+		case task.ExecError:
+			return fail(errors.New(string(payload)))
+		case task.ExecExit:
+			code := ExitError
+			json.Unmarshal(payload, &code)
+			return code
+		}
+	}
+}
+
+// sendResizes tells the command the size of the local terminal, at first
+// and whenever it changes.
+func sendResizes(conn io.Writer, mu *sync.Mutex, fd uintptr) {
+	changed := make(chan os.Signal, 1)
+	signal.Notify(changed, syscall.SIGWINCH)
+	for {
+		if ws, err := term.GetWinsize(fd); err == nil {
+			data, _ := json.Marshal(task.TerminalSize{Height: uint(ws.Height), Width: uint(ws.Width)})
+			mu.Lock()
+			task.WriteFrame(conn, task.ExecResize, data)
+			mu.Unlock()
+		}
+		<-changed
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Yuya9786/cube/manager"
+)
+
+// ManagerConfig is the configuration of `cube manager`. It can be read from
+// a YAML file given with -config; flags override the file.
+type ManagerConfig struct {
+	Host              string        `yaml:"host"`
+	Port              int           `yaml:"port"`
+	Workers           []string      `yaml:"workers"`
+	DataDir           string        `yaml:"dataDir"`
+	Scheduler         string        `yaml:"scheduler"`
+	WorkerGracePeriod time.Duration `yaml:"workerGracePeriod"`
+	RetryInterval     time.Duration `yaml:"retryInterval"`
+	UpdateInterval    time.Duration `yaml:"updateInterval"`
+	HealthInterval    time.Duration `yaml:"healthCheckInterval"`
+	ReconcileInterval time.Duration `yaml:"reconcileInterval"`
+}
+
+func defaultManagerConfig() ManagerConfig {
+	return ManagerConfig{
+		Host:              "0.0.0.0",
+		Port:              5555,
+		Scheduler:         "roundrobin",
+		WorkerGracePeriod: manager.DefaultWorkerGracePeriod,
+		RetryInterval:     manager.DefaultIntervals.Retry,
+		UpdateInterval:    manager.DefaultIntervals.Update,
+		HealthInterval:    manager.DefaultIntervals.HealthCheck,
+		ReconcileInterval: manager.DefaultIntervals.Reconcile,
+	}
+}
+
+func (c *ManagerConfig) validate() error {
+	var errs []error
+	if err := validatePort("port", c.Port); err != nil {
+		errs = append(errs, err)
+	}
+	for _, w := range c.Workers {
+		if err := validateAddress("worker", w); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch c.Scheduler {
+	case "roundrobin", "leastloaded", "epvm":
+	default:
+		errs = append(errs, fmt.Errorf("unknown scheduler %q, expected roundrobin, leastloaded or epvm", c.Scheduler))
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"worker grace period", c.WorkerGracePeriod},
+		{"retry interval", c.RetryInterval},
+		{"update interval", c.UpdateInterval},
+		{"health check interval", c.HealthInterval},
+		{"reconcile interval", c.ReconcileInterval},
+	}
+	for _, d := range durations {
+		if d.d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", d.name, d.d))
+		}
+	}
+	return joinErrors(errs)
+}
+
+func runManager(args []string) int {
+	cfg := defaultManagerConfig()
+	if err := loadConfig(configPath(args), &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	fs := newFlagSet("manager", "manager [flags]")
+	fs.String("config", "", "YAML file to read the configuration from")
+	fs.StringVar(&cfg.Host, "host", cfg.Host, "address to listen on")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	fs.Var(&overrideList{list: &cfg.Workers}, "worker", "host:port of a worker to use besides those that register; may be repeated")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory to keep state in; state is kept in memory when empty")
+	fs.StringVar(&cfg.Scheduler, "scheduler", cfg.Scheduler, "scheduler to place tasks with: roundrobin, leastloaded or epvm")
+	fs.DurationVar(&cfg.WorkerGracePeriod, "worker-grace-period", cfg.WorkerGracePeriod, "how long a worker may miss heartbeats before its tasks are rescheduled")
+	fs.DurationVar(&cfg.RetryInterval, "retry-interval", cfg.RetryInterval, "how long to wait before retrying a task that could not be sent to a worker")
+	fs.DurationVar(&cfg.UpdateInterval, "update-interval", cfg.UpdateInterval, "how often to poll workers for task updates")
+	fs.DurationVar(&cfg.HealthInterval, "health-check-interval", cfg.HealthInterval, "how often to run task health checks")
+	fs.DurationVar(&cfg.ReconcileInterval, "reconcile-interval", cfg.ReconcileInterval, "how often to reconcile services")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid manager configuration:\n%v\n", err)
+		return ExitUsage
+	}
+
+	dbPath := ""
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create data directory: %v\n", err)
+			return ExitError
+		}
+		dbPath = filepath.Join(cfg.DataDir, "manager.db")
+	}
+
+	fmt.Println("Starting Cube manager")
+
+	m, err := manager.New(cfg.Workers, cfg.Scheduler, dbPath)
+	if err != nil {
+		log.Printf("Error creating manager: %v\n", err)
+		return ExitError
+	}
+	defer m.Close()
+	m.WorkerGracePeriod = cfg.WorkerGracePeriod
+	m.Intervals = manager.Intervals{
+		Retry:       cfg.RetryInterval,
+		Update:      cfg.UpdateInterval,
+		HealthCheck: cfg.HealthInterval,
+		Reconcile:   cfg.ReconcileInterval,
+	}
+
+	go m.ProcessTasks()
+	go m.UpdateTasks()
+	go m.DoHalthChecks()
+	go m.CheckNodes()
+	go m.ReconcileServices()
+
+	mapi := manager.Api{Address: cfg.Host, Port: cfg.Port, Manager: m}
+	if err := mapi.Start(); err != nil {
+		log.Printf("Error serving manager API: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
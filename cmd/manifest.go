@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/manager"
+)
+
+// readManifests reads and merges the manifests in the given YAML or JSON
+// files.
+func readManifests(paths []string) (manager.Manifest, error) {
+	merged := manager.Manifest{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return merged, fmt.Errorf("Unable to read manifest: %w", err)
+		}
+		mf := manager.Manifest{}
+		if err := decodeSpec(data, &mf); err != nil {
+			return merged, fmt.Errorf("Unable to parse manifest %s: %w", path, err)
+		}
+		merged.Tasks = append(merged.Tasks, mf.Tasks...)
+		merged.Services = append(merged.Services, mf.Services...)
+	}
+	return merged, nil
+}
+
+// runManifest is the shared body of apply, diff and delete.
+func runManifest(name string, args []string,
+	do func(c *client.Client, mf manager.Manifest) ([]manager.Change, error),
+	print func(w io.Writer, changes []manager.Change)) int {
+	fs := newFlagSet(name, name+" [flags] -f FILE...")
+	endpoint := endpointFlag(fs)
+	output := outputFlag(fs, "text", "json")
+	var files stringList
+	fs.Var(&files, "f", "YAML or JSON manifest; may be repeated")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := validateOutput(*output, "text", "json"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "At least one manifest is required")
+		fs.Usage()
+		return ExitUsage
+	}
+
+	mf, err := readManifests(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	changes, err := do(client.New(*endpoint), mf)
+	if err != nil {
+		return fail(err)
+	}
+
+	if *output == "json" {
+		writeJSON(os.Stdout, changes)
+	} else {
+		print(os.Stdout, changes)
+	}
+	return ExitOK
+}
+
+var pastTense = map[string]string{
+	manager.ChangeCreate:    "created",
+	manager.ChangeUpdate:    "updated",
+	manager.ChangeReplace:   "replaced",
+	manager.ChangeDelete:    "deleted",
+	manager.ChangeUnchanged: "unchanged",
+}
+
+func printChanges(w io.Writer, changes []manager.Change) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s/%s %s\n", c.Kind, c.Name, pastTense[c.Action])
+	}
+}
+
+func printDiff(w io.Writer, changes []manager.Change) {
+	pending := 0
+	for _, c := range changes {
+		if c.Action == manager.ChangeUnchanged {
+			continue
+		}
+		pending++
+		fmt.Fprintf(w, "%s/%s would be %s\n", c.Kind, c.Name, pastTense[c.Action])
+		for _, f := range c.Fields {
+			switch {
+			case f.Old == "":
+				fmt.Fprintf(w, "  + %s: %s\n", f.Field, f.New)
+			case f.New == "":
+				fmt.Fprintf(w, "  - %s: %s\n", f.Field, f.Old)
+			default:
+				fmt.Fprintf(w, "  ~ %s: %s -> %s\n", f.Field, f.Old, f.New)
+			}
+		}
+	}
+	if pending == 0 {
+		fmt.Fprintln(w, "No changes")
+	}
+}
+
+func runApply(args []string) int {
+	return runManifest("apply", args, (*client.Client).Apply, printChanges)
+}
+
+func runDiff(args []string) int {
+	return runManifest("diff", args, (*client.Client).Diff, printDiff)
+}
+
+func runDelete(args []string) int {
+	return runManifest("delete", args, (*client.Client).DeleteManifest, printChanges)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/docker/go-units"
+)
+
+func runNodes(args []string) int {
+	fs := newFlagSet("nodes", "nodes [flags]")
+	endpoint := endpointFlag(fs)
+	output := outputFlag(fs, "table", "json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := validateOutput(*output, "table", "json"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	nodes, err := client.New(*endpoint).GetNodes()
+	if err != nil {
+		return fail(err)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	if *output == "json" {
+		writeJSON(os.Stdout, nodes)
+		return ExitOK
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tSCHEDULING\tCPU\tMEMORY\tDISK\tTASKS\tLAST SEEN")
+	for _, n := range nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.2f/%d\t%s/%s\t%s/%s\t%d\t%s\n",
+			n.Name, n.Status, n.Scheduling,
+			n.CpuAllocated, n.Cores,
+			units.BytesSize(float64(n.MemoryAllocated)), units.BytesSize(float64(n.Memory)),
+			units.BytesSize(float64(n.DiskAllocated)), units.BytesSize(float64(n.Disk)),
+			n.TaskCount, age(n.LastUpdated))
+	}
+	tw.Flush()
+	return ExitOK
+}
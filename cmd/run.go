@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/task"
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+func runRun(args []string) int {
+	fs := newFlagSet("run", "run [flags] [IMAGE [COMMAND [ARG...]]]")
+	endpoint := endpointFlag(fs)
+	output := outputFlag(fs, "id", "json")
+	file := fs.String("f", "", "YAML or JSON file with the task spec; flags override it")
+	name := fs.String("name", "", "name of the task")
+	runtime := fs.String("runtime", "", "runtime to run the task on, e.g. docker or process (default the worker's)")
+	cpu := fs.Float64("cpu", 0, "CPUs to reserve")
+	memory := fs.String("memory", "", "memory to reserve, e.g. 512m")
+	disk := fs.String("disk", "", "disk to reserve, e.g. 1g")
+	entrypoint := fs.String("entrypoint", "", "override the image's entrypoint")
+	workdir := fs.String("workdir", "", "working directory inside the task")
+	user := fs.String("user", "", "user to run the task as")
+	restart := fs.String("restart", "", "restart policy")
+	health := fs.String("health", "", "path to check the task's health on")
+	var env, ports, volumes, tmpfs stringList
+	fs.Var(&env, "e", "KEY=VALUE environment variable; may be repeated")
+	fs.Var(&ports, "p", "[HOST:]CONTAINER[/PROTO] port to publish, HOST may be a range; may be repeated")
+	fs.Var(&volumes, "v", "SOURCE:TARGET[:ro] volume, or bind mount when SOURCE is a path; may be repeated")
+	fs.Var(&tmpfs, "tmpfs", "TARGET of a tmpfs mount; may be repeated")
+	if code, ok := parseArgs(fs, args, 0, -1); !ok {
+		return code
+	}
+	if err := validateOutput(*output, "id", "json"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	t := task.Task{}
+	if *file != "" {
+		if err := readSpec(*file, &t); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if fs.NArg() > 0 {
+		t.Image = fs.Arg(0)
+		if fs.NArg() > 1 {
+			t.Cmd = fs.Args()[1:]
+		}
+	}
+	if set["name"] {
+		t.Name = *name
+	}
+	if set["runtime"] {
+		t.Runtime = *runtime
+	}
+	if set["cpu"] {
+		t.Cpu = *cpu
+	}
+	if set["entrypoint"] {
+		t.Entrypoint = []string{*entrypoint}
+	}
+	if set["workdir"] {
+		t.WorkingDir = *workdir
+	}
+	if set["user"] {
+		t.User = *user
+	}
+	if set["restart"] {
+		t.RestartPolicy = *restart
+	}
+	if set["health"] {
+		t.HealthCheck = *health
+	}
+	t.Env = append(t.Env, env...)
+
+	var errs []error
+	if set["memory"] {
+		if n, err := units.RAMInBytes(*memory); err != nil {
+			errs = append(errs, fmt.Errorf("invalid memory %q: %v", *memory, err))
+		} else {
+			t.Memory = n
+		}
+	}
+	if set["disk"] {
+		if n, err := units.RAMInBytes(*disk); err != nil {
+			errs = append(errs, fmt.Errorf("invalid disk %q: %v", *disk, err))
+		} else {
+			t.Disk = n
+		}
+	}
+	for _, p := range ports {
+		if err := addPortBinding(&t, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, v := range volumes {
+		m, err := parseVolume(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		t.Mounts = append(t.Mounts, m)
+	}
+	for _, target := range tmpfs {
+		t.Mounts = append(t.Mounts, task.Mount{Type: task.MountTmpfs, Target: target})
+	}
+	for _, e := range t.Env {
+		if !strings.Contains(e, "=") {
+			errs = append(errs, fmt.Errorf("environment variable %q must be KEY=VALUE", e))
+		}
+	}
+	if t.Image == "" {
+		errs = append(errs, fmt.Errorf("an image is required, either as an argument or in the spec"))
+	}
+	if err := joinErrors(errs); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid task:\n%v\n", err)
+		return ExitUsage
+	}
+
+	created, err := client.New(*endpoint).RunTask(t)
+	if err != nil {
+		return fail(err)
+	}
+
+	if *output == "json" {
+		writeJSON(os.Stdout, created)
+	} else {
+		fmt.Println(created.ID)
+	}
+	return ExitOK
+}
+
+// readSpec reads a task spec from a YAML or JSON file. Fields are named as
+// in the API's JSON, matched without regard to case.
+func readSpec(path string, t *task.Task) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read task spec: %w", err)
+	}
+	if err := decodeSpec(data, t); err != nil {
+		return fmt.Errorf("Unable to parse task spec %s: %w", path, err)
+	}
+	return nil
+}
+
+// decodeSpec decodes YAML, of which JSON is a subset, into v by way of
+// JSON so that v's JSON decoding rules apply.
+func decodeSpec(data []byte, v any) error {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// addPortBinding adds a -p value to the task's port bindings.
+func addPortBinding(t *task.Task, spec string) error {
+	hostSpec, containerPort := "", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		hostSpec, containerPort = spec[:i], spec[i+1:]
+	}
+	if _, _, _, err := task.ParsePortBinding(containerPort, hostSpec); err != nil {
+		return err
+	}
+	if t.PortBindings == nil {
+		t.PortBindings = make(map[string]string)
+	}
+	t.PortBindings[containerPort] = hostSpec
+	return nil
+}
+
+// parseVolume parses a -v value. Sources that are paths make bind mounts,
+// other sources name volumes.
+func parseVolume(spec string) (task.Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return task.Mount{}, fmt.Errorf("volume %q must be SOURCE:TARGET[:ro]", spec)
+	}
+
+	m := task.Mount{Type: task.MountVolume, Source: parts[0], Target: parts[1]}
+	if filepath.IsAbs(m.Source) || strings.HasPrefix(m.Source, ".") {
+		m.Type = task.MountBind
+		abs, err := filepath.Abs(m.Source)
+		if err != nil {
+			return task.Mount{}, err
+		}
+		m.Source = abs
+	}
+	if len(parts) == 3 {
+		if parts[2] != "ro" && parts[2] != "rw" {
+			return task.Mount{}, fmt.Errorf("volume %q has unknown option %q", spec, parts[2])
+		}
+		m.ReadOnly = parts[2] == "ro"
+	}
+	return m, nil
+}
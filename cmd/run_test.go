@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Yuya9786/cube/manager"
+	"github.com/Yuya9786/cube/task"
+)
+
+func TestDecodeSpec(t *testing.T) {
+	tk := task.Task{}
+	if err := decodeSpec([]byte("name: web\nimage: nginx\n"), &tk); err != nil {
+		t.Fatal(err)
+	}
+	if tk.Name != "web" || tk.Image != "nginx" {
+		t.Errorf("decoded name %q and image %q", tk.Name, tk.Image)
+	}
+}
+
+func TestDecodeSpecUnknownField(t *testing.T) {
+	tk := task.Task{}
+	err := decodeSpec([]byte("name: web\nimgae: nginx\n"), &tk)
+	if err == nil || !strings.Contains(err.Error(), "imgae") {
+		t.Errorf("error is %v, want one about the misspelled field", err)
+	}
+
+	mf := manager.Manifest{}
+	err = decodeSpec([]byte("tasks:\n- name: web\n  imgae: nginx\n"), &mf)
+	if err == nil || !strings.Contains(err.Error(), "imgae") {
+		t.Errorf("error is %v, want one about the misspelled field of the manifest's task", err)
+	}
+}
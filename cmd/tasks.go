@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Yuya9786/cube/client"
+	"github.com/Yuya9786/cube/manager"
+	"github.com/Yuya9786/cube/task"
+)
+
+func runPs(args []string) int {
+	fs := newFlagSet("ps", "ps [flags]")
+	endpoint := endpointFlag(fs)
+	output := outputFlag(fs, "table", "wide", "json")
+	all := fs.Bool("a", false, "show completed and failed tasks too")
+	service := fs.String("service", "", "only show tasks of this service")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := validateOutput(*output, "table", "wide", "json"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	tasks, err := client.New(*endpoint).GetTasks()
+	if err != nil {
+		return fail(err)
+	}
+
+	shown := []*task.Task{}
+	for _, t := range tasks {
+		if *service != "" && t.Service != *service {
+			continue
+		}
+		if !*all {
+			switch t.FSM.Current() {
+			case task.Completed, task.Failed:
+				continue
+			}
+		}
+		shown = append(shown, t)
+	}
+	sort.Slice(shown, func(i, j int) bool {
+		if shown[i].Name != shown[j].Name {
+			return shown[i].Name < shown[j].Name
+		}
+		return shown[i].ID.String() < shown[j].ID.String()
+	})
+
+	if *output == "json" {
+		writeJSON(os.Stdout, shown)
+		return ExitOK
+	}
+
+	tw := newTable(os.Stdout)
+	wide := *output == "wide"
+	if wide {
+		fmt.Fprintln(tw, "ID\tNAME\tIMAGE\tSTATE\tSTARTED\tSERVICE\tRUNTIME\tPORTS\tCONTAINER\tREASON")
+	} else {
+		fmt.Fprintln(tw, "ID\tNAME\tIMAGE\tSTATE\tSTARTED")
+	}
+	for _, t := range shown {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s", shortID(t.ID), orDash(t.Name), t.Image, t.FSM.Current(), age(t.StartTime))
+		if wide {
+			container := t.ContainerId
+			if len(container) > 12 {
+				container = container[:12]
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\t%s", orDash(t.Service), orDash(t.Runtime),
+				orDash(formatPorts(t)), orDash(container), orDash(reason(t)))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return ExitOK
+}
+
+// reason is why a task is pending or why it failed.
+func reason(t *task.Task) string {
+	if t.PendingReason != "" {
+		return t.PendingReason
+	}
+	if t.FSM.Current() == task.Failed {
+		return t.Error
+	}
+	return ""
+}
+
+func formatPorts(t *task.Task) string {
+	ports := []string{}
+	for containerPort, bindings := range t.HostPorts {
+		for _, b := range bindings {
+			ports = append(ports, fmt.Sprintf("%s->%s", b.HostPort, containerPort))
+		}
+	}
+	sort.Strings(ports)
+	return strings.Join(ports, ",")
+}
+
+func runStop(args []string) int {
+	fs := newFlagSet("stop", "stop [flags] TASK...")
+	endpoint := endpointFlag(fs)
+	if code, ok := parseArgs(fs, args, 1, -1); !ok {
+		return code
+	}
+
+	c := client.New(*endpoint)
+	code := ExitOK
+	for _, ref := range fs.Args() {
+		id, err := resolveTask(c, ref)
+		if err == nil {
+			err = c.StopTask(id)
+		}
+		if err != nil {
+			code = fail(err)
+			continue
+		}
+		fmt.Println(id)
+	}
+	return code
+}
+
+func runInspect(args []string) int {
+	fs := newFlagSet("inspect", "inspect [flags] TASK...")
+	endpoint := endpointFlag(fs)
+	if code, ok := parseArgs(fs, args, 1, -1); !ok {
+		return code
+	}
+
+	c := client.New(*endpoint)
+	code := ExitOK
+	records := []*manager.TaskRecord{}
+	for _, ref := range fs.Args() {
+		id, err := resolveTask(c, ref)
+		if err != nil {
+			code = fail(err)
+			continue
+		}
+		r, err := c.GetTask(id)
+		if err != nil {
+			code = fail(err)
+			continue
+		}
+		records = append(records, r)
+	}
+	writeJSON(os.Stdout, records)
+	return code
+}
+
+func runLogs(args []string) int {
+	fs := newFlagSet("logs", "logs [flags] TASK")
+	endpoint := endpointFlag(fs)
+	opts := task.LogOptions{}
+	fs.BoolVar(&opts.Follow, "f", false, "keep streaming new output")
+	fs.BoolVar(&opts.Follow, "follow", false, "keep streaming new output")
+	since := fs.String("since", "", "only show output since a timestamp or a duration ago, e.g. 10m")
+	fs.IntVar(&opts.Tail, "tail", 0, "only show this many of the last lines (0 for all)")
+	fs.BoolVar(&opts.Stdout, "stdout", false, "only show stdout, unless -stderr is given too")
+	fs.BoolVar(&opts.Stderr, "stderr", false, "only show stderr, unless -stdout is given too")
+	if code, ok := parseArgs(fs, args, 1, 1); !ok {
+		return code
+	}
+	if *since != "" {
+		t, err := task.ParseSince(*since, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+		opts.Since = t
+	}
+	if opts.Tail < 0 {
+		fmt.Fprintln(os.Stderr, "-tail cannot be negative")
+		return ExitUsage
+	}
+
+	c := client.New(*endpoint)
+	id, err := resolveTask(c, fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	logs, err := c.Logs(id, opts)
+	if err != nil {
+		return fail(err)
+	}
+	defer logs.Close()
+
+	if _, err := io.Copy(os.Stdout, logs); err != nil {
+		return fail(err)
+	}
+	return ExitOK
+}
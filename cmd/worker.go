@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/worker"
+)
+
+// WorkerConfig is the configuration of `cube worker`. It can be read from a
+// YAML file given with -config; flags override the file.
+type WorkerConfig struct {
+	Host           string        `yaml:"host"`
+	Port           int           `yaml:"port"`
+	Name           string        `yaml:"name"`
+	Manager        string        `yaml:"manager"`
+	DataDir        string        `yaml:"dataDir"`
+	Runtime        string        `yaml:"runtime"`
+	Reap           bool          `yaml:"reap"`
+	Concurrency    int           `yaml:"concurrency"`
+	UpdateInterval time.Duration `yaml:"updateInterval"`
+	StatsInterval  time.Duration `yaml:"statsInterval"`
+	ResyncInterval time.Duration `yaml:"resyncInterval"`
+}
+
+func defaultWorkerConfig() WorkerConfig {
+	return WorkerConfig{
+		Host:           "0.0.0.0",
+		Port:           5556,
+		Runtime:        task.RuntimeDocker,
+		Concurrency:    worker.DefaultConcurrency,
+		UpdateInterval: worker.DefaultIntervals.Update,
+		StatsInterval:  worker.DefaultIntervals.Stats,
+		ResyncInterval: worker.DefaultIntervals.Resync,
+	}
+}
+
+func (c *WorkerConfig) validate() error {
+	var errs []error
+	if err := validatePort("port", c.Port); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateAddress("name", c.Name); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Manager != "" {
+		u, err := url.Parse(c.Manager)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("manager %q must be an http:// or https:// URL", c.Manager))
+		}
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency))
+	}
+	switch c.Runtime {
+	case task.RuntimeDocker, task.RuntimeProcess:
+	default:
+		errs = append(errs, fmt.Errorf("unknown runtime %q, expected docker or process", c.Runtime))
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"update interval", c.UpdateInterval},
+		{"stats interval", c.StatsInterval},
+		{"resync interval", c.ResyncInterval},
+	}
+	for _, d := range durations {
+		if d.d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", d.name, d.d))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// defaultWorkerName is the address the manager reaches the worker on when
+// no name is given: the listen address, or the hostname when listening on
+// all interfaces.
+func defaultWorkerName(host string, port int) string {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if h, err := os.Hostname(); err == nil {
+			host = h
+		}
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+func runWorker(args []string) int {
+	cfg := defaultWorkerConfig()
+	if err := loadConfig(configPath(args), &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	fs := newFlagSet("worker", "worker [flags]")
+	fs.String("config", "", "YAML file to read the configuration from")
+	fs.StringVar(&cfg.Host, "host", cfg.Host, "address to listen on")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "host:port the manager reaches this worker on (default the hostname and port)")
+	fs.StringVar(&cfg.Manager, "manager", cfg.Manager, "URL of the manager to register with, e.g. http://manager:5555")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory to keep state in; state is kept in memory when empty")
+	fs.StringVar(&cfg.Runtime, "runtime", cfg.Runtime, "runtime for tasks that do not ask for one: docker or process")
+	fs.BoolVar(&cfg.Reap, "reap", cfg.Reap, "remove containers of tasks the worker has no record of on startup")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "how many task operations to run at once")
+	fs.DurationVar(&cfg.UpdateInterval, "update-interval", cfg.UpdateInterval, "how often to check the state of tasks")
+	fs.DurationVar(&cfg.StatsInterval, "stats-interval", cfg.StatsInterval, "how often to collect machine stats")
+	fs.DurationVar(&cfg.ResyncInterval, "resync-interval", cfg.ResyncInterval, "how often to check on tasks whose container events are followed")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = defaultWorkerName(cfg.Host, cfg.Port)
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid worker configuration:\n%v\n", err)
+		return ExitUsage
+	}
+
+	dbPath := ""
+	processDir := filepath.Join(os.TempDir(), "cube-process")
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create data directory: %v\n", err)
+			return ExitError
+		}
+		dbPath = filepath.Join(cfg.DataDir, "worker.db")
+		processDir = filepath.Join(cfg.DataDir, "process")
+	}
+
+	fmt.Println("Starting Cube worker")
+
+	runtimes := make(map[string]task.Runtime)
+	d, err := task.NewDocker()
+	if err != nil {
+		log.Printf("Error creating Docker client: %v\n", err)
+	} else {
+		runtimes[task.RuntimeDocker] = d
+	}
+	p, err := task.NewProcess(processDir)
+	if err != nil {
+		log.Printf("Error creating process runtime: %v\n", err)
+	} else {
+		runtimes[task.RuntimeProcess] = p
+	}
+
+	runtime, ok := runtimes[cfg.Runtime]
+	if !ok {
+		log.Printf("Runtime %s is not available\n", cfg.Runtime)
+		return ExitError
+	}
+
+	w, err := worker.New(cfg.Name, runtime, dbPath)
+	if err != nil {
+		log.Printf("Error creating worker: %v\n", err)
+		return ExitError
+	}
+	defer w.Close()
+	w.Runtimes = runtimes
+	w.Concurrency = cfg.Concurrency
+	w.Intervals = worker.Intervals{
+		Update: cfg.UpdateInterval,
+		Stats:  cfg.StatsInterval,
+		Resync: cfg.ResyncInterval,
+	}
+
+	if err := w.Reconcile(cfg.Reap); err != nil {
+		log.Printf("Error reconciling tasks with the runtime: %v\n", err)
+	}
+
+	go w.RunTasks()
+	go w.CollectState()
+	go w.UpdateTasks()
+	go w.WatchEvents()
+	if cfg.Manager != "" {
+		go w.SendHeartbeats(cfg.Manager)
+	}
+
+	wapi := worker.Api{Address: cfg.Host, Port: cfg.Port, Worker: w}
+	if err := wapi.Start(); err != nil {
+		log.Printf("Error serving worker API: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
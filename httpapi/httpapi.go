@@ -0,0 +1,48 @@
+// Package httpapi holds what the manager and worker APIs share.
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// ErrResponse is the body of an API response reporting an error.
+type ErrResponse struct {
+	HTTPStatusCode int
+	Message        string
+}
+
+// WriteError logs msg and responds with it as an ErrResponse.
+func WriteError(w http.ResponseWriter, code int, msg string) {
+	log.Print(msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	e := ErrResponse{
+		HTTPStatusCode: code,
+		Message:        msg,
+	}
+	json.NewEncoder(w).Encode(e)
+}
+
+// CopyFlushing copies src to w, flushing after every read so that streamed
+// output reaches the client right away.
+func CopyFlushing(w http.ResponseWriter, src io.Reader) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
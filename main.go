@@ -1,47 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"os"
-	"strconv"
 
-	"github.com/Yuya9786/cube/manager"
-	"github.com/Yuya9786/cube/task"
-	"github.com/Yuya9786/cube/worker"
-	"github.com/golang-collections/collections/queue"
-	"github.com/google/uuid"
+	"github.com/Yuya9786/cube/cmd"
 )
 
 func main() {
-	whost := os.Getenv("CUBE_WORKER_HOST")
-	wport, _ := strconv.Atoi(os.Getenv("CUBE_WORKER_PORT"))
-
-	mhost := os.Getenv("CUBE_MANAGER_HOST")
-	mport, _ := strconv.Atoi(os.Getenv("CUBE_MANAGER_PORT"))
-
-	fmt.Println("Strting Cube worker")
-
-	w := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
-	}
-
-	wapi := worker.Api{Address: whost, Port: wport, Worker: &w}
-
-	go w.RunTasks()
-	go w.CollectState()
-	go w.UpdateTasks()
-	go wapi.Start()
-
-	fmt.Println("Starting Cube manager")
-
-	workers := []string{fmt.Sprintf("%s:%d", whost, wport)}
-	m := manager.New(workers)
-	mapi := manager.Api{Address: mhost, Port: mport, Manager: m}
-
-	go m.ProcessTasks()
-	go m.UpdateTasks()
-	go m.DoHalthChecks()
-
-	mapi.Start()
+	os.Exit(cmd.Execute(os.Args[1:]))
 }
@@ -4,13 +4,11 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/Yuya9786/cube/httpapi"
 	"github.com/go-chi/chi/v5"
 )
 
-type ErrResponse struct {
-	HTTPStatusCode int
-	Message        string
-}
+type ErrResponse = httpapi.ErrResponse
 
 type Api struct {
 	Address string
@@ -25,12 +23,51 @@ func (a *Api) initRouter() {
 		r.Post("/", a.StartTaskHandler)
 		r.Get("/", a.GetTasksHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
+			r.Get("/", a.GetTaskHandler)
 			r.Delete("/", a.StopTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
+		})
+	})
+	a.Router.Route("/events", func(r chi.Router) {
+		r.Get("/", a.GetEventsHandler)
+	})
+	a.Router.Route("/services", func(r chi.Router) {
+		r.Post("/", a.CreateServiceHandler)
+		r.Get("/", a.GetServicesHandler)
+		r.Route("/{serviceName}", func(r chi.Router) {
+			r.Get("/", a.GetServiceHandler)
+			r.Put("/", a.UpdateServiceHandler)
+			r.Delete("/", a.DeleteServiceHandler)
+			r.Post("/rollback", a.RollbackServiceHandler)
+			r.Post("/resume", a.ResumeServiceHandler)
+		})
+	})
+	a.Router.Route("/manifest", func(r chi.Router) {
+		r.Post("/apply", a.ApplyManifestHandler)
+		r.Post("/diff", a.DiffManifestHandler)
+		r.Post("/delete", a.DeleteManifestHandler)
+	})
+	a.Router.Route("/nodes", func(r chi.Router) {
+		r.Get("/", a.GetNodesHandler)
+		r.Post("/", a.RegisterNodeHandler)
+		r.Route("/{nodeName}", func(r chi.Router) {
+			r.Delete("/", a.DeregisterNodeHandler)
+			r.Post("/heartbeat", a.HeartbeatHandler)
+			r.Post("/cordon", a.CordonNodeHandler)
+			r.Post("/uncordon", a.UncordonNodeHandler)
+			r.Post("/drain", a.DrainNodeHandler)
 		})
 	})
 }
 
-func (a *Api) Start() {
+// Handler returns the routes of the API, e.g. to serve them from a test
+// server.
+func (a *Api) Handler() http.Handler {
 	a.initRouter()
-	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
+	return a.Router
+}
+
+func (a *Api) Start() error {
+	return http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Handler())
 }
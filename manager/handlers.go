@@ -1,14 +1,18 @@
 package manager
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"time"
+	"strings"
 
+	"github.com/Yuya9786/cube/httpapi"
+	"github.com/Yuya9786/cube/node"
 	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/worker"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
@@ -19,14 +23,7 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 	te := task.TaskEvent{}
 	if err := d.Decode(&te); err != nil {
-		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
-		log.Printf(msg)
-		w.WriteHeader(400)
-		e := ErrResponse{
-			HTTPStatusCode: 400,
-			Message:        msg,
-		}
-		json.NewEncoder(w).Encode(e)
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
 		return
 	}
 
@@ -42,33 +39,366 @@ func (a *Api) GetTasksHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(a.Manager.GetTasks())
 }
 
-func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
-	taskID := chi.URLParam(r, "taskID")
-	if taskID == "" {
-		log.Println("No taskID passed in request")
-		w.WriteHeader(400)
+func (a *Api) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Invalid task ID: %v\n", err))
+		return
 	}
 
-	tID, _ := uuid.Parse(taskID)
-	taskToStop, ok := a.Manager.TaskDb[tID]
+	record, ok := a.Manager.GetTask(tID)
 	if !ok {
-		log.Printf("No task with ID %v found\n", tID)
-		w.WriteHeader(404)
+		httpapi.WriteError(w, 404, fmt.Sprintf("No task with ID %v found\n", tID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(record)
+}
+
+func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Invalid task ID: %v\n", err))
+		return
 	}
 
-	te := task.TaskEvent{
-		ID:         uuid.New(),
-		Action:     task.Stop,
-		Timestatmp: time.Now(),
-		Task:       *taskToStop,
+	if err := a.Manager.StopTask(tID); err != nil {
+		httpapi.WriteError(w, 404, fmt.Sprintf("No task with ID %v found\n", tID))
+		return
 	}
+	w.WriteHeader(204)
+}
 
-	if err := taskToStop.FSM.Event(context.Background(), "Stop"); err != nil {
-		log.Printf("Unable to transit state from %s by \"Stop\"\n", taskToStop.FSM.Current())
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Invalid task ID: %v\n", err))
+		return
 	}
 
-	a.Manager.AddTask(&te)
+	resp, err := a.Manager.TaskLogs(r.Context(), tID, r.URL.RawQuery)
+	if err != nil {
+		code := 502
+		if errors.Is(err, ErrTaskNotFound) || errors.Is(err, ErrTaskNotPlaced) {
+			code = 404
+		}
+		httpapi.WriteError(w, code, fmt.Sprintf("Error getting logs of task %v: %v\n", tID, err))
+		return
+	}
+	defer resp.Body.Close()
+
+	// Pass the worker's response through as it arrives.
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	httpapi.CopyFlushing(w, resp.Body)
+}
+
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Invalid task ID: %v\n", err))
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), task.ExecUpgrade) {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Exec needs the connection upgraded to %s\n", task.ExecUpgrade))
+		return
+	}
+
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	config := task.ExecConfig{}
+	if err := d.Decode(&config); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+	if len(config.Cmd) == 0 {
+		httpapi.WriteError(w, 400, "No command given\n")
+		return
+	}
+
+	resp, err := a.Manager.ExecTask(tID, config)
+	if err != nil {
+		code := 502
+		switch {
+		case errors.Is(err, ErrTaskNotFound) || errors.Is(err, ErrTaskNotPlaced):
+			code = 404
+		case errors.Is(err, ErrTaskNotRunning):
+			code = 409
+		}
+		httpapi.WriteError(w, code, fmt.Sprintf("Error running command in task %v: %v\n", tID, err))
+		return
+	}
+	defer resp.Body.Close()
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// Pass the worker's error through.
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	io.Copy(io.Discard, r.Body)
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		httpapi.WriteError(w, 500, fmt.Sprintf("Error taking over connection: %v\n", err))
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", task.ExecUpgrade)
 
-	log.Printf("Added task event %v to stop task %v\n", te.ID, taskToStop.ID)
+	// Splice the client and the worker together until the worker ends the
+	// session, so that the output and exit code of the command all reach
+	// the client. Clients send the end of stdin as a frame, so the client
+	// side ending means the client is gone and the worker is told by
+	// closing its connection.
+	go func() {
+		io.Copy(upstream, buf.Reader)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
+
+func (a *Api) GetEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetEvents())
+}
+
+func (a *Api) GetNodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetNodes())
+}
+
+func (a *Api) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	reg := worker.Registration{}
+	if err := d.Decode(&reg); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+
+	n, err := a.Manager.RegisterWorker(reg)
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error registering worker: %v\n", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n)
+}
+
+func (a *Api) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "nodeName")
+	hb := worker.Heartbeat{}
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+	hb.Name = name
+
+	if err := a.Manager.Heartbeat(hb); err != nil {
+		httpapi.WriteError(w, nodeErrorStatus(err), fmt.Sprintf("Error recording heartbeat of %v: %v\n", name, err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (a *Api) DeregisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "nodeName")
+	if err := a.Manager.DeregisterWorker(name); err != nil {
+		httpapi.WriteError(w, nodeErrorStatus(err), fmt.Sprintf("Error deregistering worker %v: %v\n", name, err))
+		return
+	}
 	w.WriteHeader(204)
 }
+
+func (a *Api) CordonNodeHandler(w http.ResponseWriter, r *http.Request) {
+	a.setSchedulingHandler(w, r, "cordoning", a.Manager.CordonNode)
+}
+
+func (a *Api) UncordonNodeHandler(w http.ResponseWriter, r *http.Request) {
+	a.setSchedulingHandler(w, r, "uncordoning", a.Manager.UncordonNode)
+}
+
+func (a *Api) DrainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	a.setSchedulingHandler(w, r, "draining", a.Manager.DrainNode)
+}
+
+func (a *Api) setSchedulingHandler(w http.ResponseWriter, r *http.Request, action string,
+	set func(name string) (*node.Node, error)) {
+	name := chi.URLParam(r, "nodeName")
+	n, err := set(name)
+	if err != nil {
+		httpapi.WriteError(w, nodeErrorStatus(err), fmt.Sprintf("Error %s node %v: %v\n", action, name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n)
+}
+
+func nodeErrorStatus(err error) int {
+	if errors.Is(err, ErrNodeNotFound) {
+		return 404
+	}
+	return 400
+}
+
+func serviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrServiceNotFound):
+		return 404
+	case errors.Is(err, ErrServiceExists), errors.Is(err, ErrNoPreviousRevision),
+		errors.Is(err, ErrServiceNotPaused):
+		return 409
+	}
+	return 400
+}
+
+func (a *Api) CreateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	s := Service{}
+	if err := d.Decode(&s); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+
+	if err := a.Manager.AddService(&s); err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error adding service %v: %v\n", s.Name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (a *Api) GetServicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetServices())
+}
+
+func (a *Api) GetServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "serviceName")
+	s, err := a.Manager.GetService(name)
+	if err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error getting service %v: %v\n", name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (a *Api) UpdateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "serviceName")
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	s := Service{}
+	if err := d.Decode(&s); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+	s.Name = name
+
+	if err := a.Manager.UpdateService(&s); err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error updating service %v: %v\n", name, err))
+		return
+	}
+
+	updated, _ := a.Manager.GetService(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (a *Api) DeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "serviceName")
+	if err := a.Manager.DeleteService(name); err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error deleting service %v: %v\n", name, err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (a *Api) RollbackServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "serviceName")
+	if err := a.Manager.RollbackService(name); err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error rolling back service %v: %v\n", name, err))
+		return
+	}
+
+	s, _ := a.Manager.GetService(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (a *Api) ResumeServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "serviceName")
+	if err := a.Manager.ResumeService(name); err != nil {
+		httpapi.WriteError(w, serviceErrorStatus(err), fmt.Sprintf("Error resuming service %v: %v\n", name, err))
+		return
+	}
+
+	s, _ := a.Manager.GetService(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (a *Api) decodeManifest(w http.ResponseWriter, r *http.Request) (Manifest, bool) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	mf := Manifest{}
+	if err := d.Decode(&mf); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return mf, false
+	}
+	return mf, true
+}
+
+func (a *Api) manifestHandler(w http.ResponseWriter, r *http.Request, action string,
+	do func(mf Manifest) ([]Change, error)) {
+	mf, ok := a.decodeManifest(w, r)
+	if !ok {
+		return
+	}
+
+	changes, err := do(mf)
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error %s manifest: %v\n", action, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(changes)
+}
+
+func (a *Api) ApplyManifestHandler(w http.ResponseWriter, r *http.Request) {
+	a.manifestHandler(w, r, "applying", a.Manager.Apply)
+}
+
+func (a *Api) DiffManifestHandler(w http.ResponseWriter, r *http.Request) {
+	a.manifestHandler(w, r, "diffing", a.Manager.Diff)
+}
+
+func (a *Api) DeleteManifestHandler(w http.ResponseWriter, r *http.Request) {
+	a.manifestHandler(w, r, "deleting", a.Manager.DeleteManifest)
+}
@@ -8,125 +8,484 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/scheduler"
+	"github.com/Yuya9786/cube/store"
 	"github.com/Yuya9786/cube/task"
 	"github.com/Yuya9786/cube/worker"
+	"github.com/Yuya9786/cube/workqueue"
 	"github.com/docker/go-connections/nat"
-	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 )
 
 type Manager struct {
-	Pending       queue.Queue
+	Pending *workqueue.Queue[*task.TaskEvent]
+
+	// mu guards the maps and slices below along with the tasks, nodes
+	// and services they hold. The API handlers and the manager's loops
+	// run in goroutines of their own and take mu for as long as they
+	// use them, but never while waiting on a worker. Values handed out
+	// by exported methods are copies.
+	mu            sync.Mutex
 	TaskDb        map[uuid.UUID]*task.Task
 	EventDb       map[uuid.UUID]*task.TaskEvent
 	Workers       []string
 	WorkerTaskMap map[string][]uuid.UUID
 	TaskWorkerMap map[uuid.UUID]string
-	LastWorker    int
+	WorkerNodes   []*node.Node
+	// staticWorkers are the workers the manager was created with. They
+	// do not register or send heartbeats, so their stats are polled.
+	staticWorkers map[string]bool
+	Scheduler     scheduler.Scheduler
+	TaskStore     store.Store[TaskRecord]
+	EventStore    store.Store[task.TaskEvent]
+	PendingStore  store.Store[task.TaskEvent]
+	Services      map[string]*Service
+	ServiceStore  store.Store[Service]
+
+	// WorkerGracePeriod is how long a worker may miss heartbeats before
+	// its tasks are rescheduled elsewhere.
+	WorkerGracePeriod time.Duration
+	Intervals         Intervals
 }
 
-func New(workers []string) *Manager {
+// Intervals are how long the manager's loops sleep between rounds. Retry is
+// how long a task event that could not be delivered waits before the next
+// attempt.
+type Intervals struct {
+	Retry       time.Duration
+	Update      time.Duration
+	HealthCheck time.Duration
+	Reconcile   time.Duration
+}
+
+var DefaultIntervals = Intervals{
+	Retry:       10 * time.Second,
+	Update:      10 * time.Second,
+	HealthCheck: 60 * time.Second,
+	Reconcile:   10 * time.Second,
+}
+
+// workerClient makes the manager's requests to workers and the health checks
+// of their tasks. Its timeout keeps a worker that hangs from holding up the
+// manager's loops. Followed logs and exec sessions last as long as the user
+// wants, so they do without it.
+var workerClient = &http.Client{Timeout: 10 * time.Second}
+
+func taskKey(te *task.TaskEvent) string {
+	return te.Task.ID.String()
+}
+
+// TaskRecord is how the manager persists a task along with the worker it
+// was placed on.
+type TaskRecord struct {
+	Task   task.Task
+	Worker string
+}
+
+// New creates a manager for the given workers, whose stats it polls in place
+// of heartbeats. More workers can join later by registering through the
+// API. When dbPath is empty the manager's state only lives in memory;
+// otherwise it is kept in a BoltDB file at dbPath and restored from it.
+func New(workers []string, schedulerType string, dbPath string) (*Manager, error) {
 	taskDb := make(map[uuid.UUID]*task.Task)
 	eventDb := make(map[uuid.UUID]*task.TaskEvent)
 	workerTaskMap := make(map[string][]uuid.UUID)
 	taskWorkerMap := make(map[uuid.UUID]string)
+	staticWorkers := make(map[string]bool)
+	var nodes []*node.Node
 	for _, worker := range workers {
+		staticWorkers[worker] = true
 		workerTaskMap[worker] = []uuid.UUID{}
+		api := fmt.Sprintf("http://%s", worker)
+		n := node.NewNode(worker, api, "worker")
+		n.LastUpdated = time.Now().UTC()
+		nodes = append(nodes, n)
+	}
+
+	var s scheduler.Scheduler
+	switch schedulerType {
+	case "roundrobin", "":
+		s = &scheduler.RoundRobin{Name: "roundrobin"}
+	case "leastloaded":
+		s = &scheduler.LeastLoaded{Name: "leastloaded"}
+	case "epvm":
+		s = &scheduler.Epvm{Name: "epvm"}
+	default:
+		log.Printf("Unknown scheduler %q, falling back to roundrobin\n", schedulerType)
+		s = &scheduler.RoundRobin{Name: "roundrobin"}
 	}
 
-	return &Manager{
-		Pending:       *queue.New(),
+	m := &Manager{
+		Pending:       workqueue.New(taskKey),
 		TaskDb:        taskDb,
 		EventDb:       eventDb,
 		Workers:       workers,
 		WorkerTaskMap: workerTaskMap,
 		TaskWorkerMap: taskWorkerMap,
+		WorkerNodes:   nodes,
+		staticWorkers: staticWorkers,
+		Scheduler:     s,
+		Services:      make(map[string]*Service),
+
+		WorkerGracePeriod: DefaultWorkerGracePeriod,
+		Intervals:         DefaultIntervals,
+	}
+
+	if dbPath == "" {
+		m.TaskStore = store.NewInMemoryStore[TaskRecord]()
+		m.EventStore = store.NewInMemoryStore[task.TaskEvent]()
+		m.PendingStore = store.NewInMemoryStore[task.TaskEvent]()
+		m.ServiceStore = store.NewInMemoryStore[Service]()
+		return m, nil
+	}
+
+	db, err := store.OpenBolt(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if m.TaskStore, err = store.NewBoltStore[TaskRecord](db, "tasks"); err != nil {
+		return nil, err
+	}
+	if m.EventStore, err = store.NewBoltStore[task.TaskEvent](db, "events"); err != nil {
+		return nil, err
+	}
+	if m.PendingStore, err = store.NewBoltStore[task.TaskEvent](db, "pending"); err != nil {
+		return nil, err
+	}
+	if m.ServiceStore, err = store.NewBoltStore[Service](db, "services"); err != nil {
+		return nil, err
+	}
+
+	if err := m.restore(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// restore rebuilds the in-memory maps and the pending queue from the stores.
+func (m *Manager) restore() error {
+	records, err := m.TaskStore.List()
+	if err != nil {
+		return fmt.Errorf("Unable to load tasks: %w", err)
+	}
+	for _, r := range records {
+		t := r.Task
+		m.TaskDb[t.ID] = &t
+		if r.Worker != "" {
+			m.TaskWorkerMap[t.ID] = r.Worker
+			m.WorkerTaskMap[r.Worker] = append(m.WorkerTaskMap[r.Worker], t.ID)
+			if m.getNode(r.Worker) == nil {
+				// Give the worker time to register again before its
+				// tasks are considered lost.
+				n := node.NewNode(r.Worker, fmt.Sprintf("http://%s", r.Worker), "worker")
+				n.LastUpdated = time.Now().UTC()
+				m.WorkerNodes = append(m.WorkerNodes, n)
+				m.Workers = append(m.Workers, r.Worker)
+			}
+		}
+	}
+
+	events, err := m.EventStore.List()
+	if err != nil {
+		return fmt.Errorf("Unable to load task events: %w", err)
+	}
+	for i := range events {
+		m.EventDb[events[i].ID] = &events[i]
+	}
+
+	pending, err := m.PendingStore.List()
+	if err != nil {
+		return fmt.Errorf("Unable to load pending task events: %w", err)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Timestatmp.Before(pending[j].Timestatmp)
+	})
+	for i := range pending {
+		m.Pending.Add(&pending[i])
+	}
+
+	services, err := m.ServiceStore.List()
+	if err != nil {
+		return fmt.Errorf("Unable to load services: %w", err)
+	}
+	for i := range services {
+		m.Services[services[i].Name] = &services[i]
+	}
+
+	for _, n := range m.WorkerNodes {
+		m.updateNodeAllocations(n)
+	}
+
+	log.Printf("Restored %d tasks, %d events, %d pending events and %d services\n",
+		len(records), len(events), len(pending), len(services))
+
+	return nil
+}
+
+func (m *Manager) Close() error {
+	if err := m.TaskStore.Close(); err != nil {
+		return err
+	}
+	if err := m.EventStore.Close(); err != nil {
+		return err
+	}
+	if err := m.PendingStore.Close(); err != nil {
+		return err
+	}
+	return m.ServiceStore.Close()
+}
+
+func (m *Manager) saveTask(t *task.Task) {
+	r := TaskRecord{
+		Task:   *t,
+		Worker: m.TaskWorkerMap[t.ID],
+	}
+	if err := m.TaskStore.Put(t.ID.String(), r); err != nil {
+		log.Printf("Error saving task %v: %v\n", t.ID, err)
 	}
 }
 
-func (m *Manager) SelectWorker() string {
-	var newWorker int
-	if m.LastWorker+1 < len(m.Workers) {
-		newWorker = m.LastWorker + 1
-		m.LastWorker++
-	} else {
-		newWorker = 0
-		m.LastWorker = 0
+func (m *Manager) saveEvent(te *task.TaskEvent) {
+	m.EventDb[te.ID] = te
+	if err := m.EventStore.Put(te.ID.String(), *te); err != nil {
+		log.Printf("Error saving task event %v: %v\n", te.ID, err)
 	}
+}
+
+func (m *Manager) enqueue(te *task.TaskEvent) {
+	m.savePending(te)
+	m.Pending.Add(te)
+}
+
+// retry queues an event again once Intervals.Retry has passed.
+func (m *Manager) retry(te *task.TaskEvent) {
+	m.savePending(te)
+	m.Pending.AddAfter(te, m.Intervals.Retry)
+}
 
-	return m.Workers[newWorker]
+func (m *Manager) savePending(te *task.TaskEvent) {
+	if err := m.PendingStore.Put(te.ID.String(), *te); err != nil {
+		log.Printf("Error saving pending task event %v: %v\n", te.ID, err)
+	}
 }
 
+// dequeue blocks until there is an event to process. ok is false once the
+// queue is closed.
+func (m *Manager) dequeue() (*task.TaskEvent, bool) {
+	te, ok := m.Pending.Get()
+	if !ok {
+		return nil, false
+	}
+	if err := m.PendingStore.Delete(te.ID.String()); err != nil {
+		log.Printf("Error removing pending task event %v: %v\n", te.ID, err)
+	}
+	return te, true
+}
+
+// SelectWorker picks the node to place a task on. The caller must hold
+// m.mu.
+func (m *Manager) SelectWorker(t task.Task) (*node.Node, error) {
+	ready := []*node.Node{}
+	for _, n := range m.WorkerNodes {
+		if n.Status == node.Ready && n.Scheduling == node.Schedulable {
+			ready = append(ready, n)
+		}
+	}
+
+	candidates := m.Scheduler.SelectCandidateNodes(t, ready)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf(
+			"No worker has %.2f CPU, %d bytes of memory, %d bytes of disk and host ports %v free for task %v",
+			t.Cpu, t.Memory, t.DiskRequest(), t.RequestedHostPorts(), t.ID)
+	}
+
+	scores := m.Scheduler.Score(t, candidates)
+	selectedNode := m.Scheduler.Pick(scores, candidates)
+	if selectedNode == nil {
+		return nil, fmt.Errorf("No node selected for task %v", t.ID)
+	}
+
+	return selectedNode, nil
+}
+
+// ProcessTasks sends queued task events to workers as they arrive. Events
+// that cannot be delivered yet are retried after Intervals.Retry. It returns
+// when the queue is closed.
 func (m *Manager) ProcessTasks() {
 	for {
-		log.Println("Processing any task in the queue")
-		m.SendTask()
-		log.Println("Sleeping for 10 seconds")
-		time.Sleep(10 * time.Second)
+		te, ok := m.dequeue()
+		if !ok {
+			return
+		}
+		m.SendTask(te)
+		m.Pending.Done(te)
 	}
 }
 
-func (m *Manager) SendTask() {
-	if m.Pending.Len() > 0 {
-		w := m.SelectWorker()
+func (m *Manager) SendTask(te *task.TaskEvent) {
+	t := te.Task
+	log.Printf("Pulled %v off pending queue\n", t)
 
-		e := m.Pending.Dequeue()
-		te := e.(task.TaskEvent)
-		t := te.Task
-		log.Printf("Pulled %v off pending queue\n", t)
+	w, ok := m.placeTask(te)
+	if !ok {
+		return
+	}
 
-		m.EventDb[te.ID] = &te
-		m.WorkerTaskMap[w] = append(m.WorkerTaskMap[w], t.ID)
-		m.TaskWorkerMap[t.ID] = w
+	data, err := json.Marshal(te)
+	if err != nil {
+		log.Printf("Unable to marshal task object: %v\n", err)
+	}
 
-		t.FSM = task.NewFSM()
-		m.TaskDb[t.ID] = &t
+	url := fmt.Sprintf("http://%s/tasks", w)
+	resp, err := workerClient.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		log.Printf("Error connecting to %v: %v\n", w, err)
+		m.retry(te)
+		return
+	}
 
-		data, err := json.Marshal(te)
+	d := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		e := worker.ErrResponse{}
+		err := d.Decode(&e)
 		if err != nil {
-			log.Printf("Unable to marshal task object: %v\n", err)
+			log.Printf("Error decoding response: %v\n", err)
+			return
 		}
+		log.Printf("Response error (%d): %s\n", e.HTTPStatusCode, e.Message)
+		if resp.StatusCode == http.StatusConflict && te.Action == task.Start {
+			// The worker could not give the task its ports; try
+			// placing it again.
+			m.mu.Lock()
+			m.unassign(t.ID)
+			if cur, ok := m.TaskDb[t.ID]; ok {
+				cur.FSM = task.NewFSM()
+				cur.PendingReason = e.Message
+				m.saveTask(cur)
+			}
+			m.mu.Unlock()
+			m.retry(te)
+		}
+		return
+	}
 
-		url := fmt.Sprintf("http://%s/tasks", w)
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	// t may be the task held in TaskDb, so decode into a fresh one.
+	accepted := task.Task{}
+	err = d.Decode(&accepted)
+	if err != nil {
+		log.Printf("Error decoding response: %v\n", err)
+		return
+	}
+	log.Printf("%#v\n", accepted)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.TaskDb[t.ID]; ok && len(accepted.HostPorts) > 0 {
+		cur.HostPorts = accepted.HostPorts
+		m.saveTask(cur)
+	}
+
+	if n := m.getNode(w); n != nil {
+		m.updateNodeAllocations(n)
+	}
+}
+
+// placeTask returns the worker an event goes to, scheduling the task first
+// if it has not been placed yet. ok is false when the event was dropped or
+// queued to be retried.
+func (m *Manager) placeTask(te *task.TaskEvent) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := te.Task
+	m.saveEvent(te)
+
+	// Events for a task that has already been placed go to the worker
+	// running it; only new tasks go through the scheduler.
+	w, ok := m.TaskWorkerMap[t.ID]
+	if !ok && te.Action != task.Start {
+		log.Printf("Task %v has not been placed on a worker, dropping %v event\n", t.ID, te.Action)
+		return "", false
+	}
+	if cur, found := m.TaskDb[t.ID]; !ok && found && cur.FSM.Current() == task.Completed {
+		log.Printf("Task %v was cancelled before being placed, dropping it\n", t.ID)
+		return "", false
+	}
+	if !ok {
+		n, err := m.SelectWorker(t)
 		if err != nil {
-			log.Printf("Error connecting to %v: %v\n", w, err)
-			m.Pending.Enqueue(te)
-			return
+			// Hold the task as Pending until a worker has room for
+			// it, so that it shows up in GET /tasks with the reason.
+			log.Printf("Error selecting worker for task %v: %v\n", t.ID, err)
+			t.FSM = task.NewFSM()
+			t.PendingReason = err.Error()
+			m.TaskDb[t.ID] = &t
+			m.saveTask(&t)
+			m.retry(te)
+			return "", false
 		}
+		w = n.Name
+		t.PendingReason = ""
 
-		d := json.NewDecoder(resp.Body)
-		if resp.StatusCode != http.StatusCreated {
-			e := worker.ErrResponse{}
-			err := d.Decode(&e)
-			if err != nil {
-				log.Printf("Error decoding response: %v\n", err)
-				return
-			}
-			log.Printf("Response error (%d): %s\n", e.HTTPStatusCode, e.Message)
-			return
+		m.WorkerTaskMap[w] = append(m.WorkerTaskMap[w], t.ID)
+		m.TaskWorkerMap[t.ID] = w
+
+		t.FSM = task.NewFSM()
+		t.FSM.Event(context.Background(), task.Schedule)
+		m.TaskDb[t.ID] = &t
+		m.saveTask(&t)
+		m.updateNodeAllocations(n)
+	}
+
+	return w, true
+}
+
+// unassign removes a task from the worker it was placed on.
+func (m *Manager) unassign(id uuid.UUID) {
+	w, ok := m.TaskWorkerMap[id]
+	if !ok {
+		return
+	}
+	delete(m.TaskWorkerMap, id)
+
+	ids := []uuid.UUID{}
+	for _, tid := range m.WorkerTaskMap[w] {
+		if tid != id {
+			ids = append(ids, tid)
 		}
+	}
+	m.WorkerTaskMap[w] = ids
 
-		t = task.Task{}
-		err = d.Decode(&t)
-		if err != nil {
-			log.Printf("Error decoding response: %v\n", err)
-			return
+	if n := m.getNode(w); n != nil {
+		m.updateNodeAllocations(n)
+	}
+}
+
+func (m *Manager) getNode(name string) *node.Node {
+	for _, n := range m.WorkerNodes {
+		if n.Name == name {
+			return n
 		}
-		log.Printf("%#v\n", t)
-	} else {
-		log.Println("No work in the queue")
 	}
+	return nil
 }
 
 func (m *Manager) updateTasks() {
-	for _, w := range m.Workers {
+	m.mu.Lock()
+	workers := append([]string{}, m.Workers...)
+	m.mu.Unlock()
+
+	for _, w := range workers {
 		log.Printf("Checking worker %v for task updates", w)
 		url := fmt.Sprintf("http://%s/tasks", w)
-		resp, err := http.Get(url)
+		resp, err := workerClient.Get(url)
 		if err != nil {
 			log.Printf("Error connecting to %v: %v\n", w, err)
 			continue
@@ -150,24 +509,59 @@ func (m *Manager) updateTasks() {
 			log.Printf("Error decoding response: %v\n", err)
 			return
 		}
-		for _, t := range tasks {
-			log.Printf("Attempt to update task %v", t.ID)
 
-			_, ok := m.TaskDb[t.ID]
-			if !ok {
-				log.Printf("Task with %v not found\n", t.ID)
-				return
-			}
-			if m.TaskDb[t.ID].FSM.Current() != t.FSM.Current() {
-				m.TaskDb[t.ID].FSM = t.FSM
+		stale := m.applyTaskUpdates(w, tasks)
+		for _, id := range stale {
+			m.stopStaleTask(w, id)
+		}
+	}
+}
+
+// applyTaskUpdates records the state a worker reported for its tasks. It
+// returns the running tasks the worker should no longer have.
+func (m *Manager) applyTaskUpdates(w string, tasks []*task.Task) []uuid.UUID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stale := []uuid.UUID{}
+	for _, t := range tasks {
+		log.Printf("Attempt to update task %v", t.ID)
+
+		if _, ok := m.TaskDb[t.ID]; !ok {
+			log.Printf("Task with %v not found\n", t.ID)
+			continue
+		}
+		if assigned := m.TaskWorkerMap[t.ID]; assigned != w {
+			// The task was moved off the worker, because the worker
+			// was lost or drained, and is waiting for or running on
+			// another one. What is left of it here says nothing
+			// about the task.
+			if t.FSM.Current() == task.Running {
+				stale = append(stale, t.ID)
 			}
+			continue
+		}
 
-			m.TaskDb[t.ID].StartTime = t.StartTime
-			m.TaskDb[t.ID].FinishTime = t.FinishTime
-			m.TaskDb[t.ID].ContainerId = t.ContainerId
-			m.TaskDb[t.ID].HostPorts = t.HostPorts
+		if m.TaskDb[t.ID].FSM.Current() != t.FSM.Current() {
+			m.TaskDb[t.ID].FSM = t.FSM
 		}
+
+		m.TaskDb[t.ID].StartTime = t.StartTime
+		m.TaskDb[t.ID].FinishTime = t.FinishTime
+		m.TaskDb[t.ID].ContainerId = t.ContainerId
+		m.TaskDb[t.ID].HostPorts = t.HostPorts
+		m.TaskDb[t.ID].ExitCode = t.ExitCode
+		m.TaskDb[t.ID].OOMKilled = t.OOMKilled
+		m.TaskDb[t.ID].Health = t.Health
+		m.TaskDb[t.ID].Error = t.Error
+		m.TaskDb[t.ID].Output = t.Output
+		m.saveTask(m.TaskDb[t.ID])
+	}
+
+	if n := m.getNode(w); n != nil {
+		m.updateNodeAllocations(n)
 	}
+	return stale
 }
 
 func (m *Manager) UpdateTasks() {
@@ -175,18 +569,243 @@ func (m *Manager) UpdateTasks() {
 		log.Println("Checking for task updates from workers")
 		m.updateTasks()
 		log.Println("Task updates completed")
-		time.Sleep(time.Second * 10)
+		time.Sleep(m.Intervals.Update)
+	}
+}
+
+// updateNodeAllocations recomputes the resources a node has committed to
+// tasks from the tasks the manager has placed on it. Tasks that have
+// completed or failed no longer hold their allocation.
+func (m *Manager) updateNodeAllocations(n *node.Node) {
+	cpu := 0.0
+	memory, disk, count := 0, 0, 0
+	ports := []int{}
+	for _, id := range m.WorkerTaskMap[n.Name] {
+		t, ok := m.TaskDb[id]
+		if !ok {
+			continue
+		}
+		switch t.FSM.Current() {
+		case task.Completed, task.Failed:
+			continue
+		}
+		cpu += t.Cpu
+		memory += int(t.Memory)
+		disk += int(t.DiskRequest())
+		count++
+		ports = append(ports, t.RequestedHostPorts()...)
+		ports = append(ports, t.AllocatedHostPorts()...)
 	}
+	sort.Ints(ports)
+	n.UsedPorts = ports
+	n.CpuAllocated = cpu
+	n.MemoryAllocated = memory
+	n.DiskAllocated = disk
+	n.TaskCount = count
 }
 
+func (m *Manager) GetNodes() []*node.Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nodes := []*node.Node{}
+	for _, n := range m.WorkerNodes {
+		nodes = append(nodes, copyNode(n))
+	}
+	return nodes
+}
+
+// AddTask queues a task event. Tasks being started for the first time are
+// recorded as Pending right away so that they show up in GET /tasks.
 func (m *Manager) AddTask(te *task.TaskEvent) {
-	m.Pending.Enqueue(te)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addTask(te)
+}
+
+func (m *Manager) addTask(te *task.TaskEvent) {
+	if _, ok := m.TaskDb[te.Task.ID]; !ok && te.Action == task.Start {
+		t := te.Task
+		t.FSM = task.NewFSM()
+		m.TaskDb[t.ID] = &t
+		m.saveTask(&t)
+	}
+	m.enqueue(te)
+}
+
+// stopTask marks a task Completed and queues a Stop event for the worker
+// running it. A task that has not been placed yet is just cancelled.
+func (m *Manager) stopTask(t *task.Task) {
+	placed := m.TaskWorkerMap[t.ID] != ""
+	if state := t.FSM.Current(); !placed && (state == task.Pending || state == task.Lost) {
+		t.FSM.SetState(task.Completed)
+		t.FinishTime = time.Now().UTC()
+		m.saveTask(t)
+		log.Printf("Cancelled pending task %v\n", t.ID)
+		return
+	}
+
+	te := task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     task.Stop,
+		Timestatmp: time.Now(),
+		Task:       *t,
+	}
+
+	if err := t.FSM.Event(context.Background(), task.Stop); err != nil {
+		log.Printf("Unable to transit state from %s by \"Stop\"\n", t.FSM.Current())
+	}
+	m.saveTask(t)
+
+	m.addTask(&te)
+	log.Printf("Added task event %v to stop task %v\n", te.ID, t.ID)
+}
+
+// StopTask stops the task with the given ID.
+func (m *Manager) StopTask(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.TaskDb[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	m.stopTask(t)
+	return nil
+}
+
+// stopStaleTask stops a task on a worker it is no longer assigned to.
+func (m *Manager) stopStaleTask(w string, id uuid.UUID) {
+	log.Printf("Stopping stale copy of task %v on worker %v\n", id, w)
+	url := fmt.Sprintf("http://%s/tasks/%s", w, id)
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		log.Printf("Error creating request to stop task %v: %v\n", id, err)
+		return
+	}
+	resp, err := workerClient.Do(req)
+	if err != nil {
+		log.Printf("Error connecting to %v: %v\n", w, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+var (
+	ErrTaskNotFound   = errors.New("task not found")
+	ErrTaskNotPlaced  = errors.New("task has not been placed on a worker")
+	ErrTaskNotRunning = errors.New("task is not running")
+)
+
+// GetTask returns a task along with the worker it was placed on.
+func (m *Manager) GetTask(id uuid.UUID) (TaskRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.TaskDb[id]
+	if !ok {
+		return TaskRecord{}, false
+	}
+	return TaskRecord{Task: *t.Clone(), Worker: m.TaskWorkerMap[id]}, true
+}
+
+// TaskLogs asks the worker a task was placed on for the task's output,
+// passing on the log options in query. The request is cancelled with ctx,
+// which ends a followed stream. The caller has to close the response body.
+func (m *Manager) TaskLogs(ctx context.Context, id uuid.UUID, query string) (*http.Response, error) {
+	w, err := m.taskWorker(id)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://%s/tasks/%s/logs", w, id)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %v: %w", w, err)
+	}
+	return resp, nil
+}
+
+// ExecTask asks the worker a running task was placed on to run a command in
+// the task's container. If the worker accepts, the response has status 101
+// Switching Protocols and its body is an io.ReadWriteCloser carrying the
+// session's frames; any other response is the worker's error. The caller
+// has to close the response body.
+func (m *Manager) ExecTask(id uuid.UUID, config task.ExecConfig) (*http.Response, error) {
+	m.mu.Lock()
+	t, ok := m.TaskDb[id]
+	running := ok && t.FSM.Current() == task.Running
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if !running {
+		return nil, ErrTaskNotRunning
+	}
+
+	w, err := m.taskWorker(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("http://%s/tasks/%s/exec", w, id)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", task.ExecUpgrade)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %v: %w", w, err)
+	}
+	return resp, nil
+}
+
+// taskWorker returns the worker a task was placed on.
+func (m *Manager) taskWorker(id uuid.UUID) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.TaskDb[id]; !ok {
+		return "", ErrTaskNotFound
+	}
+	w, ok := m.TaskWorkerMap[id]
+	if !ok {
+		return "", ErrTaskNotPlaced
+	}
+	return w, nil
+}
+
+// GetEvents returns the task events the manager has received, oldest first.
+func (m *Manager) GetEvents() []*task.TaskEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []*task.TaskEvent{}
+	for _, te := range m.EventDb {
+		events = append(events, te)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestatmp.Before(events[j].Timestatmp)
+	})
+	return events
 }
 
 func (m *Manager) GetTasks() []*task.Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	tasks := []*task.Task{}
 	for _, t := range m.TaskDb {
-		tasks = append(tasks, t)
+		tasks = append(tasks, t.Clone())
 	}
 
 	return tasks
@@ -194,23 +813,36 @@ func (m *Manager) GetTasks() []*task.Task {
 
 func getHostPort(ports nat.PortMap) *string {
 	for k := range ports {
+		if len(ports[k]) == 0 {
+			continue
+		}
 		return &ports[k][0].HostPort
 	}
 	return nil
 }
 
-func (m *Manager) checkTaskHealth(t *task.Task) error {
-	w := m.TaskWorkerMap[t.ID]
+// healthCheck is a task to be checked along with the worker it runs on,
+// taken so that the check can run without holding m.mu.
+type healthCheck struct {
+	worker string
+	task   task.Task
+}
+
+func (m *Manager) checkTaskHealth(w string, t *task.Task) error {
 	hostPort := getHostPort(t.HostPorts)
+	if hostPort == nil {
+		return fmt.Errorf("Task %s has no host port to check health on", t.ID)
+	}
 	worker := strings.Split(w, ":")
 	url := fmt.Sprintf("http://%s:%s%s", worker[0], *hostPort, t.HealthCheck)
 	log.Printf("Calling health check for task %s: %s\n", t.ID, url)
-	resp, err := http.Get(url)
+	resp, err := workerClient.Get(url)
 	if err != nil {
 		msg := fmt.Sprintf("Error connecting to %s: %v\n", url, err)
 		log.Printf(msg)
 		return errors.New(msg)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		msg := fmt.Sprintf("Error health check for task %s did not return 200\n", t.ID)
@@ -223,31 +855,52 @@ func (m *Manager) checkTaskHealth(t *task.Task) error {
 	return nil
 }
 
-func (m *Manager) restartTask(t *task.Task) error {
+// prepareRestart moves a task to Running again and returns the event that
+// restarts it along with the worker it runs on.
+func (m *Manager) prepareRestart(id uuid.UUID) (*task.TaskEvent, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.TaskDb[id]
+	if !ok {
+		return nil, "", ErrTaskNotFound
+	}
 	// Get the worker where the task was running
 	w := m.TaskWorkerMap[t.ID]
 	if err := t.FSM.Event(context.Background(), task.Restart); err != nil {
-		return fmt.Errorf("Unable to transition task %v: %w", t, err)
+		return nil, "", fmt.Errorf("Unable to transition task %v: %w", t, err)
 	}
 	t.RestartCount++
-	// Overwite the existing task to ensure it has the current state
-	m.TaskDb[t.ID] = t
+	m.saveTask(t)
+	// A failed task holds its resources and ports again.
+	if n := m.getNode(w); n != nil {
+		m.updateNodeAllocations(n)
+	}
 
 	te := task.TaskEvent{
 		ID:         uuid.New(),
 		Action:     task.Restart,
 		Timestatmp: time.Now(),
-		Task:       *t,
+		Task:       *t.Clone(),
+	}
+	return &te, w, nil
+}
+
+func (m *Manager) restartTask(id uuid.UUID) error {
+	te, w, err := m.prepareRestart(id)
+	if err != nil {
+		return err
 	}
+
 	data, err := json.Marshal(te)
 	if err != nil {
 		return fmt.Errorf("Unable to marshal task event object %#+v: %w", te, err)
 	}
 
 	url := fmt.Sprintf("http://%s/tasks", w)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	resp, err := workerClient.Post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		m.Pending.Enqueue(te)
+		m.enqueue(te)
 		return fmt.Errorf("Unable to connect to %s: %w", url, err)
 	}
 
@@ -270,18 +923,32 @@ func (m *Manager) restartTask(t *task.Task) error {
 }
 
 func (m *Manager) doHealthChecks() {
+	m.mu.Lock()
+	checks := []healthCheck{}
+	failed := []uuid.UUID{}
 	for _, t := range m.TaskDb {
-		if t.FSM.Current() == task.Running && t.RestartCount < 3 {
-			err := m.checkTaskHealth(t)
-			if err != nil {
-				if err = m.restartTask(t); err != nil {
-					log.Println(err)
-				}
-			}
-		} else if t.FSM.Current() == task.Failed && t.RestartCount < 3 {
-			if err := m.restartTask(t); err != nil {
-				log.Println(err)
-			}
+		if t.FSM.Current() == task.Running && t.RestartCount < 3 && t.Health == "unhealthy" {
+			// The container's own health check, as reported by the
+			// worker, failed.
+			failed = append(failed, t.ID)
+		} else if t.FSM.Current() == task.Running && t.RestartCount < 3 && t.HealthCheck != "" {
+			checks = append(checks, healthCheck{worker: m.TaskWorkerMap[t.ID], task: *t.Clone()})
+		} else if t.FSM.Current() == task.Failed && t.RestartCount < 3 && t.Service == "" {
+			// Failed tasks of a service are replaced by the service
+			// reconciliation instead of being restarted.
+			failed = append(failed, t.ID)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, c := range checks {
+		if err := m.checkTaskHealth(c.worker, &c.task); err != nil {
+			failed = append(failed, c.task.ID)
+		}
+	}
+	for _, id := range failed {
+		if err := m.restartTask(id); err != nil {
+			log.Println(err)
 		}
 	}
 }
@@ -291,6 +958,6 @@ func (m *Manager) DoHalthChecks() {
 		log.Println("Performing task health check")
 		m.doHealthChecks()
 		log.Println("Task health checks completed")
-		time.Sleep(60 * time.Second)
+		time.Sleep(m.Intervals.HealthCheck)
 	}
 }
@@ -0,0 +1,332 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/worker"
+	"github.com/google/uuid"
+)
+
+// testWorker is a worker running tasks on the fake runtime behind a test
+// server.
+type testWorker struct {
+	*worker.Worker
+	Fake *task.Fake
+	Addr string
+}
+
+func newTestWorker(t *testing.T) *testWorker {
+	t.Helper()
+	fake := task.NewFake()
+	w, err := worker.New("test", fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.RunTasks()
+	go w.WatchEvents()
+	t.Cleanup(w.Queue.Close)
+
+	srv := httptest.NewServer((&worker.Api{Worker: w}).Handler())
+	t.Cleanup(srv.Close)
+	return &testWorker{Worker: w, Fake: fake, Addr: strings.TrimPrefix(srv.URL, "http://")}
+}
+
+// newTestManager returns a manager with one ready worker.
+func newTestManager(t *testing.T) (*Manager, *testWorker) {
+	t.Helper()
+	w := newTestWorker(t)
+	m, err := New([]string{w.Addr}, "roundrobin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Intervals.Retry = time.Hour
+	if err := m.Heartbeat(worker.Heartbeat{Name: w.Addr, Stats: &worker.Stats{Cores: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	return m, w
+}
+
+func newEvent(action string, t task.Task) *task.TaskEvent {
+	return &task.TaskEvent{ID: uuid.New(), Action: action, Timestatmp: time.Now(), Task: t}
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func workerState(w *testWorker, id uuid.UUID) string {
+	for _, t := range w.GetTasks() {
+		if t.ID == id {
+			return t.FSM.Current()
+		}
+	}
+	return ""
+}
+
+func managerTask(t *testing.T, m *Manager, id uuid.UUID) TaskRecord {
+	t.Helper()
+	r, ok := m.GetTask(id)
+	if !ok {
+		t.Fatalf("task %v not found", id)
+	}
+	return r
+}
+
+// startTask sends a new task to the worker and waits for it to run there.
+func startTask(t *testing.T, m *Manager, w *testWorker) task.Task {
+	t.Helper()
+	tk := task.Task{ID: uuid.New(), Name: "test", Image: "test"}
+	m.SendTask(newEvent(task.Start, tk))
+	waitFor(t, "the task to run", func() bool { return workerState(w, tk.ID) == task.Running })
+	return tk
+}
+
+func TestSendTask(t *testing.T) {
+	m, w := newTestManager(t)
+	tk := task.Task{ID: uuid.New(), Name: "test", Image: "test"}
+
+	m.SendTask(newEvent(task.Start, tk))
+	r := managerTask(t, m, tk.ID)
+	if r.Worker != w.Addr {
+		t.Errorf("task placed on %q, want %q", r.Worker, w.Addr)
+	}
+	if r.Task.FSM.Current() != task.Scheduled {
+		t.Errorf("task is %v, want %v", r.Task.FSM.Current(), task.Scheduled)
+	}
+	waitFor(t, "the task to run", func() bool { return workerState(w, tk.ID) == task.Running })
+}
+
+func TestSendTaskPortConflict(t *testing.T) {
+	m, w := newTestManager(t)
+	w.Ports.Reserve(uuid.New(), []int{31000})
+	tk := task.Task{ID: uuid.New(), Name: "test", Image: "test",
+		PortBindings: map[string]string{"80/tcp": "31000"}}
+
+	m.SendTask(newEvent(task.Start, tk))
+	r := managerTask(t, m, tk.ID)
+	if r.Worker != "" {
+		t.Errorf("task still placed on %q", r.Worker)
+	}
+	if r.Task.FSM.Current() != task.Pending || r.Task.PendingReason == "" {
+		t.Errorf("task is %v with reason %q, want it pending with the worker's error",
+			r.Task.FSM.Current(), r.Task.PendingReason)
+	}
+	if n := m.GetNodes()[0]; len(n.UsedPorts) != 0 {
+		t.Errorf("node still counts ports %v as used", n.UsedPorts)
+	}
+}
+
+func TestSendStopTask(t *testing.T) {
+	m, w := newTestManager(t)
+	tk := startTask(t, m, w)
+	m.updateTasks()
+
+	if err := m.StopTask(tk.ID); err != nil {
+		t.Fatal(err)
+	}
+	te, _ := m.dequeue()
+	m.SendTask(te)
+	waitFor(t, "the task to stop", func() bool { return workerState(w, tk.ID) == task.Completed })
+	if len(w.Fake.Containers) != 0 {
+		t.Errorf("%d containers left", len(w.Fake.Containers))
+	}
+}
+
+func TestUpdateTasks(t *testing.T) {
+	m, w := newTestManager(t)
+	tk := startTask(t, m, w)
+
+	m.updateTasks()
+	r := managerTask(t, m, tk.ID)
+	if r.Task.FSM.Current() != task.Running || r.Task.ContainerId == "" {
+		t.Fatalf("task is %v with container %q, want it running", r.Task.FSM.Current(), r.Task.ContainerId)
+	}
+
+	w.Fake.Write(r.Task.ContainerId, "panic: oops")
+	w.Fake.Exit(r.Task.ContainerId, 2)
+	waitFor(t, "the task to fail", func() bool { return workerState(w, tk.ID) == task.Failed })
+
+	m.updateTasks()
+	r = managerTask(t, m, tk.ID)
+	if r.Task.FSM.Current() != task.Failed {
+		t.Fatalf("task is %v, want %v", r.Task.FSM.Current(), task.Failed)
+	}
+	if r.Task.ExitCode != 2 || len(r.Task.Output) == 0 || r.Task.Output[0] != "panic: oops" {
+		t.Errorf("exit code %d and output %q not reported", r.Task.ExitCode, r.Task.Output)
+	}
+}
+
+func TestUpdateTasksFromUnassignedWorker(t *testing.T) {
+	m, w := newTestManager(t)
+	tk := startTask(t, m, w)
+
+	// The task has been moved to another worker in the meantime.
+	m.mu.Lock()
+	m.unassign(tk.ID)
+	m.TaskWorkerMap[tk.ID] = "other:5556"
+	m.TaskDb[tk.ID].FSM.SetState(task.Scheduled)
+	m.mu.Unlock()
+
+	m.updateTasks()
+	if r := managerTask(t, m, tk.ID); r.Task.FSM.Current() != task.Scheduled || r.Task.ContainerId != "" {
+		t.Errorf("task is %v with container %q, want the report ignored", r.Task.FSM.Current(), r.Task.ContainerId)
+	}
+	waitFor(t, "the stale copy to stop", func() bool { return workerState(w, tk.ID) == task.Completed })
+}
+
+// TestConcurrentAccess drives the API while the manager's loops run, for
+// go test -race to find unsynchronized access to the manager's state.
+func TestConcurrentAccess(t *testing.T) {
+	m, w := newTestManager(t)
+	m.Intervals.Retry = 10 * time.Millisecond
+	srv := httptest.NewServer((&Api{Manager: m}).Handler())
+	t.Cleanup(srv.Close)
+	go m.ProcessTasks()
+	t.Cleanup(m.Pending.Close)
+
+	call := func(method string, path string, body any) {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s %s: %v", method, path, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 && resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+	}
+
+	var wg sync.WaitGroup
+	repeat := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	for n := 0; n < 4; n++ {
+		repeat(func(i int) {
+			tk := task.Task{ID: uuid.New(), Name: "test", Image: "test"}
+			call(http.MethodPost, "/tasks", newEvent(task.Start, tk))
+			call(http.MethodGet, "/tasks", nil)
+			call(http.MethodGet, "/tasks/"+tk.ID.String(), nil)
+			call(http.MethodGet, "/tasks/"+tk.ID.String()+"/logs", nil)
+			if i%2 == 0 {
+				call(http.MethodDelete, "/tasks/"+tk.ID.String(), nil)
+			}
+		})
+	}
+	repeat(func(i int) {
+		s := Service{Name: "web", Replicas: 3, Template: task.Task{Name: "web", Image: "test"}}
+		if i == 0 {
+			call(http.MethodPost, "/services", s)
+		}
+		s.Replicas = i % 4
+		call(http.MethodPut, "/services/web", s)
+		call(http.MethodGet, "/services", nil)
+		call(http.MethodGet, "/nodes", nil)
+		call(http.MethodGet, "/events", nil)
+	})
+	repeat(func(i int) {
+		// Containers exiting make the worker fail their tasks, which
+		// the manager then restarts or replaces.
+		containers, _ := w.Fake.ListTasks()
+		for j, c := range containers {
+			if j%3 == i%3 {
+				w.Fake.Exit(c.ID, 1)
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	})
+	repeat(func(int) { m.updateTasks() })
+	repeat(func(int) { m.doHealthChecks() })
+	repeat(func(int) { m.reconcileServices() })
+	repeat(func(int) {
+		m.pollStaticWorkers()
+		m.mu.Lock()
+		m.checkNodes()
+		m.drainNodes()
+		m.mu.Unlock()
+	})
+	wg.Wait()
+
+	if tasks := m.GetTasks(); len(tasks) == 0 {
+		t.Error("no tasks recorded")
+	}
+	for _, tk := range w.GetTasks() {
+		if _, ok := m.GetTask(tk.ID); !ok {
+			t.Errorf("worker runs task %v unknown to the manager", tk.ID)
+		}
+	}
+}
+
+func TestExecTask(t *testing.T) {
+	m, w := newTestManager(t)
+	srv := httptest.NewServer((&Api{Manager: m}).Handler())
+	t.Cleanup(srv.Close)
+	tk := startTask(t, m, w)
+	m.updateTasks()
+
+	data, _ := json.Marshal(task.ExecConfig{Cmd: []string{"cat"}, Stdin: true})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/tasks/"+tk.ID.String()+"/exec", bytes.NewReader(data))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", task.ExecUpgrade)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		t.Fatalf("connection not upgraded: %s", resp.Status)
+	}
+	defer conn.Close()
+
+	task.WriteFrame(conn, task.ExecStdin, []byte("hello\n"))
+	task.WriteFrame(conn, task.ExecCloseStdin, nil)
+
+	var out bytes.Buffer
+	for {
+		kind, payload, err := task.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("session ended before the exit code: %v", err)
+		}
+		if kind == task.ExecStdout {
+			out.Write(payload)
+			continue
+		}
+		if kind != task.ExecExit {
+			t.Fatalf("unexpected frame %d: %q", kind, payload)
+		}
+		break
+	}
+	if out.String() != "cat\nhello\n" {
+		t.Errorf("output is %q", out.String())
+	}
+}
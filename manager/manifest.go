@@ -0,0 +1,336 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+// Manifest describes tasks and services to be kept running. Standalone
+// tasks are identified by their name, services by theirs.
+type Manifest struct {
+	Tasks    []task.Task
+	Services []Service
+}
+
+// Change actions
+const (
+	ChangeCreate    = "create"
+	ChangeUpdate    = "update"
+	ChangeReplace   = "replace"
+	ChangeDelete    = "delete"
+	ChangeUnchanged = "unchanged"
+)
+
+// Change kinds
+const (
+	KindTask    = "task"
+	KindService = "service"
+)
+
+// Change is what applying or deleting a manifest does to one task or
+// service. Fields lists the differences for updates and replacements.
+type Change struct {
+	Kind   string
+	Name   string
+	Action string
+	Fields []FieldChange `json:",omitempty"`
+}
+
+// FieldChange is one field that differs between what is running and what a
+// manifest asks for. Old and New hold JSON encoded values; an empty string
+// means the field is not set.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func validateManifest(mf *Manifest) error {
+	tasks := make(map[string]bool)
+	for _, t := range mf.Tasks {
+		if t.Name == "" {
+			return errors.New("tasks in a manifest need a name")
+		}
+		if t.Image == "" {
+			return fmt.Errorf("task %s has no image", t.Name)
+		}
+		if tasks[t.Name] {
+			return fmt.Errorf("task %s is defined more than once", t.Name)
+		}
+		tasks[t.Name] = true
+	}
+
+	services := make(map[string]bool)
+	for i := range mf.Services {
+		s := &mf.Services[i]
+		if err := validateService(s); err != nil {
+			return fmt.Errorf("invalid service %s: %w", s.Name, err)
+		}
+		if services[s.Name] {
+			return fmt.Errorf("service %s is defined more than once", s.Name)
+		}
+		services[s.Name] = true
+	}
+	return nil
+}
+
+// taskSpec strips the fields the manager and workers fill in from a task,
+// leaving what the user asked for.
+func taskSpec(t task.Task) task.Task {
+	t.ID = uuid.Nil
+	t.Service = ""
+	t.ServiceRevision = 0
+	t.FSM = nil
+	t.State = ""
+	t.ContainerId = ""
+	t.HostPorts = nil
+	t.RestartCount = 0
+	t.PendingReason = ""
+	t.StartTime = time.Time{}
+	t.FinishTime = time.Time{}
+	t.ExitCode = 0
+	t.OOMKilled = false
+	t.Health = ""
+	t.Error = ""
+	t.Output = nil
+	return t
+}
+
+// serviceSpec is the part of a service a manifest sets.
+type serviceSpec struct {
+	Template         task.Task
+	Replicas         int
+	UpdateConfig     UpdateConfig
+	DisruptionBudget int
+}
+
+func specOfService(s *Service) serviceSpec {
+	return serviceSpec{
+		Template:         taskSpec(s.Template),
+		Replicas:         s.Replicas,
+		UpdateConfig:     s.UpdateConfig,
+		DisruptionBudget: s.DisruptionBudget,
+	}
+}
+
+// diffFields compares the JSON encodings of old and new field by field,
+// descending into nested objects.
+func diffFields(old any, new any) []FieldChange {
+	flat := func(v any) map[string]string {
+		data, _ := json.Marshal(v)
+		var doc any
+		json.Unmarshal(data, &doc)
+		fields := make(map[string]string)
+		flatten("", doc, fields)
+		return fields
+	}
+	o, n := flat(old), flat(new)
+
+	changes := []FieldChange{}
+	for field, ov := range o {
+		if nv := n[field]; nv != ov {
+			changes = append(changes, FieldChange{Field: field, Old: ov, New: nv})
+		}
+	}
+	for field, nv := range n {
+		if _, ok := o[field]; !ok {
+			changes = append(changes, FieldChange{Field: field, New: nv})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// flatten records the leaves of a decoded JSON document under their dotted
+// paths. Empty and null values count as unset.
+func flatten(prefix string, v any, fields map[string]string) {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flatten(path, child, fields)
+		}
+		return
+	case nil:
+		return
+	case string:
+		if val == "" {
+			return
+		}
+	case float64:
+		if val == 0 {
+			return
+		}
+	case bool:
+		if !val {
+			return
+		}
+	case []any:
+		if len(val) == 0 {
+			return
+		}
+	}
+	data, _ := json.Marshal(v)
+	fields[prefix] = string(data)
+}
+
+// standaloneTasks returns the active tasks with the given name that do not
+// belong to a service.
+func (m *Manager) standaloneTasks(name string) []*task.Task {
+	tasks := []*task.Task{}
+	for _, t := range m.TaskDb {
+		if t.Name == name && t.Service == "" && isActive(t) {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+// Diff works out what applying a manifest would change.
+func (m *Manager) Diff(mf Manifest) ([]Change, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.diff(mf)
+}
+
+func (m *Manager) diff(mf Manifest) ([]Change, error) {
+	if err := validateManifest(&mf); err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	for _, t := range mf.Tasks {
+		c := Change{Kind: KindTask, Name: t.Name}
+		existing := m.standaloneTasks(t.Name)
+		switch {
+		case len(existing) == 0:
+			c.Action = ChangeCreate
+		default:
+			c.Fields = diffFields(taskSpec(*existing[0]), taskSpec(t))
+			if len(c.Fields) == 0 && len(existing) == 1 {
+				c.Action = ChangeUnchanged
+			} else {
+				c.Action = ChangeReplace
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	for i := range mf.Services {
+		s := &mf.Services[i]
+		c := Change{Kind: KindService, Name: s.Name}
+		existing, ok := m.Services[s.Name]
+		if !ok {
+			c.Action = ChangeCreate
+		} else {
+			c.Fields = diffFields(specOfService(existing), specOfService(s))
+			c.Action = ChangeUnchanged
+			if len(c.Fields) > 0 {
+				c.Action = ChangeUpdate
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+// Apply makes the tasks and services in the manifest match it, starting and
+// stopping only what differs. Tasks and services not in the manifest are
+// left alone.
+func (m *Manager) Apply(mf Manifest) ([]Change, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes, err := m.diff(mf)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make(map[string]task.Task)
+	for _, t := range mf.Tasks {
+		tasks[t.Name] = t
+	}
+	services := make(map[string]*Service)
+	for i := range mf.Services {
+		services[mf.Services[i].Name] = &mf.Services[i]
+	}
+
+	for _, c := range changes {
+		switch c.Kind {
+		case KindTask:
+			if c.Action == ChangeUnchanged {
+				continue
+			}
+			for _, old := range m.standaloneTasks(c.Name) {
+				m.stopTask(old)
+			}
+			m.startManifestTask(tasks[c.Name])
+		case KindService:
+			s := *services[c.Name]
+			switch c.Action {
+			case ChangeCreate:
+				err = m.addService(&s)
+			case ChangeUpdate:
+				err = m.updateService(&s)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to apply service %s: %w", c.Name, err)
+			}
+		}
+		log.Printf("Applied manifest: %s %s %s\n", c.Kind, c.Name, c.Action)
+	}
+
+	return changes, nil
+}
+
+func (m *Manager) startManifestTask(spec task.Task) {
+	t := taskSpec(spec)
+	t.ID = uuid.New()
+	t.FSM = task.NewFSM()
+	m.addTask(&task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     task.Start,
+		Timestatmp: time.Now(),
+		Task:       t,
+	})
+}
+
+// DeleteManifest stops the tasks and deletes the services a manifest
+// defines. Only their names matter.
+func (m *Manager) DeleteManifest(mf Manifest) ([]Change, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes := []Change{}
+	for _, t := range mf.Tasks {
+		c := Change{Kind: KindTask, Name: t.Name, Action: ChangeUnchanged}
+		for _, old := range m.standaloneTasks(t.Name) {
+			m.stopTask(old)
+			c.Action = ChangeDelete
+		}
+		changes = append(changes, c)
+	}
+
+	for _, s := range mf.Services {
+		c := Change{Kind: KindService, Name: s.Name, Action: ChangeUnchanged}
+		err := m.deleteService(s.Name)
+		switch {
+		case err == nil:
+			c.Action = ChangeDelete
+		case !errors.Is(err, ErrServiceNotFound):
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
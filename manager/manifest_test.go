@@ -0,0 +1,168 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Yuya9786/cube/task"
+)
+
+// sendQueued sends the events queued by the manager to the worker.
+func sendQueued(m *Manager) {
+	for m.Pending.Len() > 0 {
+		te, _ := m.dequeue()
+		m.SendTask(te)
+		m.Pending.Done(te)
+	}
+}
+
+func manifestTask(t *testing.T, m *Manager, name string) task.Task {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks := m.standaloneTasks(name)
+	if len(tasks) != 1 {
+		t.Fatalf("%d active tasks named %s, want 1", len(tasks), name)
+	}
+	return *tasks[0].Clone()
+}
+
+func TestApplyReplacesTask(t *testing.T) {
+	m, w := newTestManager(t)
+	mf := Manifest{Tasks: []task.Task{{Name: "web", Image: "web:1"}}}
+
+	if _, err := m.Apply(mf); err != nil {
+		t.Fatal(err)
+	}
+	sendQueued(m)
+	old := manifestTask(t, m, "web")
+	waitFor(t, "the task to run", func() bool { return workerState(w, old.ID) == task.Running })
+	m.updateTasks()
+
+	mf.Tasks[0].Image = "web:2"
+	changes, err := m.Apply(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != ChangeReplace {
+		t.Fatalf("changes are %+v, want the task replaced", changes)
+	}
+	replacement := manifestTask(t, m, "web")
+	if replacement.ID == old.ID || replacement.Image != "web:2" {
+		t.Fatalf("task %v has image %s, want a new task with web:2", replacement.ID, replacement.Image)
+	}
+
+	// Both tasks go to the same worker, which may well start the new one
+	// before it has stopped the old one.
+	stop, _ := m.dequeue()
+	start, _ := m.dequeue()
+	if stop.Action != task.Stop || start.Action != task.Start {
+		t.Fatalf("queued %v and %v, want a stop and a start", stop.Action, start.Action)
+	}
+	m.SendTask(start)
+	waitFor(t, "the new task to run", func() bool { return workerState(w, replacement.ID) == task.Running })
+	m.SendTask(stop)
+	waitFor(t, "the old task to stop", func() bool { return workerState(w, old.ID) == task.Completed })
+}
+
+func TestDiffFields(t *testing.T) {
+	old := task.Task{Image: "web:1", Env: []string{"DEBUG=1"},
+		PortBindings: map[string]string{"80/tcp": ""}}
+	new := task.Task{Image: "web:2", Memory: 512,
+		PortBindings: map[string]string{"80/tcp": "8080"}}
+
+	want := []FieldChange{
+		{Field: "Env", Old: `["DEBUG=1"]`},
+		{Field: "Image", Old: `"web:1"`, New: `"web:2"`},
+		{Field: "Memory", New: "512"},
+		{Field: "PortBindings.80/tcp", New: `"8080"`},
+	}
+	if got := diffFields(taskSpec(old), taskSpec(new)); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %+v, want %+v", got, want)
+	}
+	if got := diffFields(taskSpec(old), taskSpec(old)); len(got) != 0 {
+		t.Errorf("task differs from itself in %+v", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m, _ := newTestManager(t)
+	mf := Manifest{
+		Tasks:    []task.Task{{Name: "web", Image: "web:1"}},
+		Services: []Service{{Name: "api", Template: task.Task{Image: "api:1"}, Replicas: 2}},
+	}
+	if _, err := m.Apply(mf); err != nil {
+		t.Fatal(err)
+	}
+	sendQueued(m)
+
+	// What the manager fills in, like IDs, revisions and defaults, does
+	// not count as a change.
+	changes, err := m.Diff(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.Action != ChangeUnchanged {
+			t.Errorf("%s %s is %s with %+v, want it unchanged", c.Kind, c.Name, c.Action, c.Fields)
+		}
+	}
+
+	mf.Tasks[0].Image = "web:2"
+	mf.Tasks = append(mf.Tasks, task.Task{Name: "db", Image: "db:1"})
+	mf.Services[0].Replicas = 3
+	mf.Services = append(mf.Services, Service{Name: "cache", Template: task.Task{Image: "cache:1"}, Replicas: 1})
+	changes, err = m.Diff(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Kind: KindTask, Name: "web", Action: ChangeReplace,
+			Fields: []FieldChange{{Field: "Image", Old: `"web:1"`, New: `"web:2"`}}},
+		{Kind: KindTask, Name: "db", Action: ChangeCreate},
+		{Kind: KindService, Name: "api", Action: ChangeUpdate,
+			Fields: []FieldChange{{Field: "Replicas", Old: "2", New: "3"}}},
+		{Kind: KindService, Name: "cache", Action: ChangeCreate},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes are %+v, want %+v", changes, want)
+	}
+	if m.Pending.Len() != 0 {
+		t.Errorf("diffing queued %d events", m.Pending.Len())
+	}
+}
+
+func TestDiffInvalidManifest(t *testing.T) {
+	m, _ := newTestManager(t)
+	for _, mf := range []Manifest{
+		{Tasks: []task.Task{{Image: "web:1"}}},
+		{Tasks: []task.Task{{Name: "web"}}},
+		{Tasks: []task.Task{{Name: "web", Image: "web:1"}, {Name: "web", Image: "web:2"}}},
+		{Services: []Service{{Name: "api", Template: task.Task{Image: "api:1"}, Replicas: -1}}},
+	} {
+		if _, err := m.Diff(mf); err == nil {
+			t.Errorf("manifest %+v accepted", mf)
+		}
+	}
+}
+
+func TestApplyUnchanged(t *testing.T) {
+	m, _ := newTestManager(t)
+	mf := Manifest{Tasks: []task.Task{{Name: "web", Image: "web:1"}}}
+	if _, err := m.Apply(mf); err != nil {
+		t.Fatal(err)
+	}
+	sendQueued(m)
+	id := manifestTask(t, m, "web").ID
+
+	changes, err := m.Apply(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != ChangeUnchanged {
+		t.Fatalf("changes are %+v, want the task unchanged", changes)
+	}
+	if m.Pending.Len() != 0 || manifestTask(t, m, "web").ID != id {
+		t.Error("unchanged task replaced")
+	}
+}
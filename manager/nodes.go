@@ -0,0 +1,321 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/worker"
+	"github.com/google/uuid"
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// A worker that misses heartbeats for workerUnhealthyAfter is marked
+// Unhealthy and no longer gets new tasks. After the manager's
+// WorkerGracePeriod, which defaults to DefaultWorkerGracePeriod, it is
+// marked Down and its tasks are rescheduled onto other workers.
+const (
+	workerUnhealthyAfter     = 3 * worker.HeartbeatInterval
+	DefaultWorkerGracePeriod = time.Minute
+)
+
+// RegisterWorker adds a worker to the cluster, or marks one that registers
+// again, e.g. after a restart, as alive. The worker's name is the host:port
+// address the manager reaches its API on.
+func (m *Manager) RegisterWorker(reg worker.Registration) (*node.Node, error) {
+	if reg.Name == "" {
+		return nil, errors.New("worker name is required")
+	}
+	if _, _, err := net.SplitHostPort(reg.Name); err != nil {
+		return nil, fmt.Errorf("worker name %q is not a host:port address: %w", reg.Name, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	api := fmt.Sprintf("http://%s", reg.Name)
+
+	n := m.getNode(reg.Name)
+	if n == nil {
+		n = node.NewNode(reg.Name, api, "worker")
+		m.WorkerNodes = append(m.WorkerNodes, n)
+		m.Workers = append(m.Workers, reg.Name)
+		if _, ok := m.WorkerTaskMap[reg.Name]; !ok {
+			m.WorkerTaskMap[reg.Name] = []uuid.UUID{}
+		}
+		log.Printf("Registered worker %v at %v\n", reg.Name, api)
+	} else {
+		log.Printf("Worker %v registered again\n", reg.Name)
+	}
+	n.LastUpdated = time.Now().UTC()
+	m.updateNodeAllocations(n)
+
+	return copyNode(n), nil
+}
+
+// DeregisterWorker removes a worker from the cluster. Tasks still placed on
+// it are treated like those of a worker that went down.
+func (m *Manager) DeregisterWorker(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, n := range m.WorkerNodes {
+		if n.Name != name {
+			continue
+		}
+		m.WorkerNodes = append(m.WorkerNodes[:i], m.WorkerNodes[i+1:]...)
+		for j, w := range m.Workers {
+			if w == name {
+				m.Workers = append(m.Workers[:j], m.Workers[j+1:]...)
+				break
+			}
+		}
+		delete(m.staticWorkers, name)
+		log.Printf("Deregistered worker %v\n", name)
+		m.rescheduleTasks(name)
+		return nil
+	}
+	return ErrNodeNotFound
+}
+
+// Heartbeat records that a worker is alive along with the stats it sent.
+func (m *Manager) Heartbeat(hb worker.Heartbeat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.getNode(hb.Name)
+	if n == nil {
+		return ErrNodeNotFound
+	}
+
+	if stats := hb.Stats; stats != nil {
+		n.Cores = stats.Cores
+		if stats.MemStats != nil {
+			n.Memory = int(stats.MemTotalKb()) * 1024
+			n.MemoryUsed = int(stats.MemUsedKb()) * 1024
+		}
+		if stats.DiskStats != nil {
+			n.Disk = int(stats.DiskTotal())
+			n.DiskUsed = int(stats.DiskUsed())
+		}
+		if stats.CpuStats != nil {
+			n.CpuUsage = stats.CpuUsage()
+		}
+	}
+	if n.Status != node.Ready {
+		log.Printf("Worker %v is ready\n", n.Name)
+	}
+	n.LastUpdated = time.Now().UTC()
+	n.Status = node.Ready
+	m.updateNodeAllocations(n)
+
+	return nil
+}
+
+// pollStaticWorkers fetches the stats of the workers the manager was
+// created with and records them like heartbeats.
+func (m *Manager) pollStaticWorkers() {
+	m.mu.Lock()
+	apis := make(map[string]string)
+	for _, n := range m.WorkerNodes {
+		if m.staticWorkers[n.Name] {
+			apis[n.Name] = n.Api
+		}
+	}
+	m.mu.Unlock()
+
+	for name, api := range apis {
+		resp, err := workerClient.Get(fmt.Sprintf("%s/stats", api))
+		if err != nil {
+			log.Printf("Error connecting to %v: %v\n", name, err)
+			continue
+		}
+		stats := &worker.Stats{}
+		err = json.NewDecoder(resp.Body).Decode(stats)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			log.Printf("Error retrieving stats from %v: %v %v\n", name, resp.Status, err)
+			continue
+		}
+		if err := m.Heartbeat(worker.Heartbeat{Name: name, Stats: stats}); err != nil {
+			log.Printf("Error recording stats of %v: %v\n", name, err)
+		}
+	}
+}
+
+// checkNodes marks workers that stopped sending heartbeats as Unhealthy and
+// eventually Down, at which point their tasks are rescheduled.
+func (m *Manager) checkNodes() {
+	for _, n := range m.WorkerNodes {
+		since := time.Since(n.LastUpdated)
+		status := n.Status
+		switch {
+		case since > m.WorkerGracePeriod:
+			status = node.Down
+		case since > workerUnhealthyAfter && n.Status == node.Ready:
+			status = node.Unhealthy
+		}
+		if status != n.Status {
+			log.Printf("No heartbeat from worker %v for %v, marking it %v\n",
+				n.Name, since.Round(time.Second), status)
+			n.Status = status
+			if status == node.Down {
+				m.rescheduleTasks(n.Name)
+			}
+		}
+	}
+}
+
+// rescheduleTasks marks the tasks placed on a worker that is gone as Lost
+// and queues them to be placed on another worker.
+func (m *Manager) rescheduleTasks(w string) {
+	ids := append([]uuid.UUID{}, m.WorkerTaskMap[w]...)
+	for _, id := range ids {
+		t, ok := m.TaskDb[id]
+		if !ok {
+			continue
+		}
+		if err := t.FSM.Event(context.Background(), task.Lose); err != nil {
+			// Completed and failed tasks stay where they were.
+			continue
+		}
+		m.unassign(id)
+		m.saveTask(t)
+		log.Printf("Task %v was lost with worker %v, rescheduling it\n", id, w)
+
+		m.reschedule(t)
+	}
+}
+
+// reschedule queues a task that was taken off its worker to be placed
+// again.
+func (m *Manager) reschedule(t *task.Task) {
+	moved := *t
+	moved.ContainerId = ""
+	moved.HostPorts = nil
+	m.enqueue(&task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     task.Start,
+		Timestatmp: time.Now(),
+		Task:       moved,
+	})
+}
+
+// CordonNode stops the scheduler from placing new tasks on a node. Tasks
+// already running there keep running.
+func (m *Manager) CordonNode(name string) (*node.Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.setScheduling(name, node.Cordoned)
+	return copyNode(n), err
+}
+
+// UncordonNode lets the scheduler place tasks on a node again.
+func (m *Manager) UncordonNode(name string) (*node.Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.setScheduling(name, node.Schedulable)
+	return copyNode(n), err
+}
+
+// DrainNode cordons a node and moves its tasks to other nodes. Tasks are
+// moved gradually so that no service has more tasks in flight than its
+// disruption budget allows.
+func (m *Manager) DrainNode(name string) (*node.Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.setScheduling(name, node.Draining)
+	if err != nil {
+		return nil, err
+	}
+	m.drainNode(n)
+	return copyNode(n), nil
+}
+
+// copyNode returns a copy of a node that can still be used once m.mu is
+// released.
+func copyNode(n *node.Node) *node.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
+
+func (m *Manager) setScheduling(name string, scheduling string) (*node.Node, error) {
+	n := m.getNode(name)
+	if n == nil {
+		return nil, ErrNodeNotFound
+	}
+	if n.Scheduling != scheduling {
+		log.Printf("Marking node %v %v\n", name, scheduling)
+		n.Scheduling = scheduling
+	}
+	return n, nil
+}
+
+// drainNode moves as many tasks off a draining node as the disruption
+// budgets of their services allow. A service task being moved counts
+// against the budget until its replacement is running again.
+func (m *Manager) drainNode(n *node.Node) {
+	disrupted := make(map[string]int)
+	for _, t := range m.TaskDb {
+		if t.Service == "" {
+			continue
+		}
+		switch t.FSM.Current() {
+		case task.Pending, task.Scheduled, task.Lost:
+			disrupted[t.Service]++
+		}
+	}
+
+	ids := append([]uuid.UUID{}, m.WorkerTaskMap[n.Name]...)
+	for _, id := range ids {
+		t, ok := m.TaskDb[id]
+		if !ok {
+			continue
+		}
+		switch t.FSM.Current() {
+		case task.Scheduled, task.Running:
+		default:
+			continue
+		}
+		if s, ok := m.Services[t.Service]; ok {
+			if disrupted[s.Name] >= s.DisruptionBudget {
+				continue
+			}
+			disrupted[s.Name]++
+		}
+
+		log.Printf("Moving task %v off draining node %v\n", id, n.Name)
+		m.unassign(id)
+		go m.stopStaleTask(n.Name, id)
+		t.FSM = task.NewFSM()
+		m.saveTask(t)
+		m.reschedule(t)
+	}
+}
+
+func (m *Manager) drainNodes() {
+	for _, n := range m.WorkerNodes {
+		if n.Scheduling == node.Draining {
+			m.drainNode(n)
+		}
+	}
+}
+
+func (m *Manager) CheckNodes() {
+	for {
+		log.Println("Checking worker heartbeats")
+		m.pollStaticWorkers()
+		m.mu.Lock()
+		m.checkNodes()
+		m.drainNodes()
+		m.mu.Unlock()
+		time.Sleep(worker.HeartbeatInterval)
+	}
+}
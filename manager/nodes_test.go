@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/worker"
+)
+
+// missHeartbeats makes the manager find that a worker has been silent for
+// longer than the grace period.
+func missHeartbeats(m *Manager, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getNode(name).LastUpdated = time.Now().Add(-2 * m.WorkerGracePeriod)
+	m.checkNodes()
+}
+
+func TestRescheduleLostTask(t *testing.T) {
+	m, w := newTestManager(t)
+	tk := startTask(t, m, w)
+	m.updateTasks()
+	old := managerTask(t, m, tk.ID).Task.ContainerId
+
+	// The task fails on the worker while the worker is out of touch, and
+	// the manager gives up on it.
+	w.Fake.Exit(old, 1)
+	waitFor(t, "the task to fail", func() bool { return workerState(w, tk.ID) == task.Failed })
+	missHeartbeats(m, w.Addr)
+	if r := managerTask(t, m, tk.ID); r.Task.FSM.Current() != task.Lost || r.Worker != "" {
+		t.Fatalf("task is %v on %q, want it lost", r.Task.FSM.Current(), r.Worker)
+	}
+
+	// The worker comes back and gets the task again.
+	if err := m.Heartbeat(worker.Heartbeat{Name: w.Addr, Stats: &worker.Stats{Cores: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	te, _ := m.dequeue()
+	m.SendTask(te)
+	waitFor(t, "the task to run again", func() bool { return workerState(w, tk.ID) == task.Running })
+
+	m.updateTasks()
+	r := managerTask(t, m, tk.ID)
+	if r.Task.FSM.Current() != task.Running || r.Task.ContainerId == old {
+		t.Errorf("task is %v with container %q, want it running in a new one", r.Task.FSM.Current(), r.Task.ContainerId)
+	}
+	if _, ok := w.Fake.Containers[old]; ok {
+		t.Error("container of the failed run not removed")
+	}
+}
+
+func TestRegisterWorker(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	n, err := m.RegisterWorker(worker.Registration{Name: "worker-2:5556"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Api != "http://worker-2:5556" {
+		t.Errorf("worker API is %q", n.Api)
+	}
+
+	for _, name := range []string{"", "worker-3"} {
+		if _, err := m.RegisterWorker(worker.Registration{Name: name}); err == nil {
+			t.Errorf("worker %q registered, want an error", name)
+		}
+	}
+}
+
+func TestPollHangingWorker(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hang) })
+
+	saved := workerClient
+	workerClient = &http.Client{Timeout: 50 * time.Millisecond}
+	t.Cleanup(func() { workerClient = saved })
+
+	m, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, "roundrobin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		m.pollStaticWorkers()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("polling a hanging worker did not time out")
+	}
+}
+
+// drainProgress returns how many tasks of the service are on their way to
+// another node and how many are still on the node.
+func drainProgress(m *Manager, service string, name string) (moving int, left int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.serviceTasks(service) {
+		if !isActive(t) {
+			continue
+		}
+		if t.FSM.Current() != task.Running {
+			moving++
+		}
+		if m.TaskWorkerMap[t.ID] == name {
+			left++
+		}
+	}
+	return moving, left
+}
+
+func TestDrainNodeBudget(t *testing.T) {
+	m, w := newTestManager(t)
+	if err := m.AddService(&Service{Name: "web", Template: task.Task{Image: "web:1"}, Replicas: 3}); err != nil {
+		t.Fatal(err)
+	}
+	m.reconcileServices()
+	settle(t, m, w)
+	standalone := startTask(t, m, w)
+	m.updateTasks()
+
+	w2 := newTestWorker(t)
+	if _, err := m.RegisterWorker(worker.Registration{Name: w2.Addr}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Heartbeat(worker.Heartbeat{Name: w2.Addr, Stats: &worker.Stats{Cores: 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.DrainNode(w.Addr); err != nil {
+		t.Fatal(err)
+	}
+	if r := managerTask(t, m, standalone.ID); r.Worker == w.Addr {
+		t.Error("task without a service left on the draining node")
+	}
+	if moving, _ := drainProgress(m, "web", w.Addr); moving != 1 {
+		t.Fatalf("%d service tasks moving at once, want the budget of 1", moving)
+	}
+
+	for i := 0; ; i++ {
+		moving, left := drainProgress(m, "web", w.Addr)
+		if moving > 1 {
+			t.Fatalf("%d service tasks moving at once, want at most 1", moving)
+		}
+		if left == 0 {
+			break
+		}
+		if i == 10 {
+			t.Fatalf("%d service tasks still on the draining node", left)
+		}
+		settle(t, m, w2)
+		m.mu.Lock()
+		m.drainNodes()
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,514 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrServiceExists      = errors.New("service already exists")
+	ErrServiceNotFound    = errors.New("service not found")
+	ErrNoPreviousRevision = errors.New("service has no previous revision")
+	ErrServiceNotPaused   = errors.New("service update is not paused")
+)
+
+// Update statuses
+const (
+	UpdateInProgress  = "Updating"
+	UpdateRollingBack = "RollingBack"
+	UpdatePaused      = "Paused"
+	UpdateCompleted   = "Completed"
+)
+
+// UpdateConfig controls how a service's tasks are replaced when its template
+// changes. MaxSurge is how many tasks above Replicas may exist during the
+// update and MaxUnavailable how many below Replicas may be not running or
+// unhealthy. When both are zero MaxSurge defaults to 1.
+type UpdateConfig struct {
+	MaxSurge       int
+	MaxUnavailable int
+}
+
+// Service asks the manager to keep Replicas copies of Template running.
+// DisruptionBudget is how many of its tasks draining nodes may move at a
+// time; it defaults to 1.
+// Tasks created for a service carry its name in Task.Service and the
+// revision of the template they were created from in Task.ServiceRevision.
+// Changing the template starts a rolling update to a new revision; the
+// template it replaced is kept as PreviousTemplate for rollbacks.
+type Service struct {
+	Name              string
+	Template          task.Task
+	Replicas          int
+	Revision          int
+	PreviousTemplate  *task.Task
+	PreviousRevision  int
+	UpdateConfig      UpdateConfig
+	DisruptionBudget  int
+	UpdateStatus      string
+	UpdateMessage     string
+	UpdateStartedTime time.Time
+	CreatedTime       time.Time
+	UpdatedTime       time.Time
+
+	// stopping holds the tasks of an older revision that were stopped
+	// while Scheduled. They stay Scheduled until their worker reports
+	// back, so they are only asked to stop once.
+	stopping map[uuid.UUID]bool
+}
+
+func (s *Service) updating() bool {
+	return s.UpdateStatus == UpdateInProgress || s.UpdateStatus == UpdateRollingBack
+}
+
+func validateService(s *Service) error {
+	if s.Name == "" {
+		return errors.New("service name is required")
+	}
+	if s.Template.Image == "" {
+		return fmt.Errorf("template of service %s has no image", s.Name)
+	}
+	if s.Replicas < 0 {
+		return fmt.Errorf("replicas must not be negative, got %d", s.Replicas)
+	}
+	if s.UpdateConfig.MaxSurge < 0 || s.UpdateConfig.MaxUnavailable < 0 {
+		return errors.New("max surge and max unavailable must not be negative")
+	}
+	if s.UpdateConfig.MaxSurge == 0 && s.UpdateConfig.MaxUnavailable == 0 {
+		s.UpdateConfig.MaxSurge = 1
+	}
+	if s.DisruptionBudget < 0 {
+		return fmt.Errorf("disruption budget must not be negative, got %d", s.DisruptionBudget)
+	}
+	if s.DisruptionBudget == 0 {
+		s.DisruptionBudget = 1
+	}
+	return nil
+}
+
+func sameTemplate(a, b task.Task) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aj, bj)
+}
+
+func (m *Manager) saveService(s *Service) {
+	if err := m.ServiceStore.Put(s.Name, *s); err != nil {
+		log.Printf("Error saving service %v: %v\n", s.Name, err)
+	}
+}
+
+func (m *Manager) AddService(s *Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addService(s)
+}
+
+func (m *Manager) addService(s *Service) error {
+	if err := validateService(s); err != nil {
+		return err
+	}
+	if _, ok := m.Services[s.Name]; ok {
+		return ErrServiceExists
+	}
+
+	s.CreatedTime = time.Now().UTC()
+	s.UpdatedTime = s.CreatedTime
+	s.Revision = 1
+	s.PreviousTemplate = nil
+	s.PreviousRevision = 0
+	s.UpdateStatus = ""
+	s.UpdateMessage = ""
+	added := *s
+	m.Services[s.Name] = &added
+	m.saveService(&added)
+	log.Printf("Added service %v with %d replicas\n", s.Name, s.Replicas)
+
+	return nil
+}
+
+// UpdateService changes the replica count and update config of an existing
+// service. A changed template becomes a new revision, which the
+// reconciliation rolls out by gradually replacing the service's tasks.
+func (m *Manager) UpdateService(s *Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updateService(s)
+}
+
+func (m *Manager) updateService(s *Service) error {
+	if err := validateService(s); err != nil {
+		return err
+	}
+	existing, ok := m.Services[s.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+
+	existing.Replicas = s.Replicas
+	existing.UpdateConfig = s.UpdateConfig
+	existing.DisruptionBudget = s.DisruptionBudget
+	existing.UpdatedTime = time.Now().UTC()
+
+	if !sameTemplate(existing.Template, s.Template) {
+		// After a rollback the previous revision is the newer one, so
+		// number the new revision past both.
+		next := existing.Revision + 1
+		if existing.PreviousRevision >= next {
+			next = existing.PreviousRevision + 1
+		}
+		previous := existing.Template
+		existing.PreviousTemplate = &previous
+		existing.PreviousRevision = existing.Revision
+		existing.Template = s.Template
+		existing.Revision = next
+		existing.UpdateStatus = UpdateInProgress
+		existing.UpdateMessage = ""
+		existing.UpdateStartedTime = existing.UpdatedTime
+		log.Printf("Rolling out revision %d of service %v\n", existing.Revision, s.Name)
+	}
+
+	m.saveService(existing)
+	log.Printf("Updated service %v to %d replicas\n", s.Name, s.Replicas)
+
+	return nil
+}
+
+// RollbackService makes the previous template current again and rolls the
+// service's tasks back to it. The template being rolled back from becomes
+// the previous one.
+func (m *Manager) RollbackService(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.Services[name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	if s.PreviousTemplate == nil {
+		return ErrNoPreviousRevision
+	}
+
+	current := s.Template
+	s.Template = *s.PreviousTemplate
+	s.PreviousTemplate = &current
+	s.Revision, s.PreviousRevision = s.PreviousRevision, s.Revision
+	s.UpdateStatus = UpdateRollingBack
+	s.UpdateMessage = ""
+	s.UpdatedTime = time.Now().UTC()
+	s.UpdateStartedTime = s.UpdatedTime
+	m.saveService(s)
+	log.Printf("Rolling service %v back to revision %d\n", name, s.Revision)
+
+	return nil
+}
+
+// ResumeService continues an update that was paused after a failure.
+func (m *Manager) ResumeService(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.Services[name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	if s.UpdateStatus != UpdatePaused {
+		return ErrServiceNotPaused
+	}
+
+	s.UpdateStatus = UpdateInProgress
+	s.UpdateMessage = ""
+	s.UpdatedTime = time.Now().UTC()
+	s.UpdateStartedTime = s.UpdatedTime
+	m.saveService(s)
+	log.Printf("Resumed update of service %v\n", name)
+
+	return nil
+}
+
+// DeleteService removes a service and stops all of its tasks.
+func (m *Manager) DeleteService(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteService(name)
+}
+
+func (m *Manager) deleteService(name string) error {
+	if _, ok := m.Services[name]; !ok {
+		return ErrServiceNotFound
+	}
+
+	for _, t := range m.serviceTasks(name) {
+		if isActive(t) {
+			m.stopTask(t)
+		}
+	}
+
+	delete(m.Services, name)
+	if err := m.ServiceStore.Delete(name); err != nil {
+		log.Printf("Error deleting service %v: %v\n", name, err)
+	}
+	log.Printf("Deleted service %v\n", name)
+
+	return nil
+}
+
+func (m *Manager) GetServices() []*Service {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	services := []*Service{}
+	for _, s := range m.Services {
+		c := *s
+		services = append(services, &c)
+	}
+	return services
+}
+
+func (m *Manager) GetService(name string) (*Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.Services[name]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *Manager) serviceTasks(name string) []*task.Task {
+	tasks := []*task.Task{}
+	for _, t := range m.TaskDb {
+		if t.Service == name {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+// isActive reports whether the task is running or on its way to running.
+// Lost tasks are being rescheduled and so count as well.
+func isActive(t *task.Task) bool {
+	switch t.FSM.Current() {
+	case task.Pending, task.Scheduled, task.Running, task.Lost:
+		return true
+	}
+	return false
+}
+
+// newServiceTask creates a task from the service's template.
+func newServiceTask(s *Service) task.Task {
+	t := taskSpec(s.Template)
+	t.ID = uuid.New()
+	t.Name = fmt.Sprintf("%s-%s", s.Name, t.ID.String()[:8])
+	t.Service = s.Name
+	t.ServiceRevision = s.Revision
+	t.FSM = task.NewFSM()
+	return t
+}
+
+func (m *Manager) startServiceTask(s *Service) {
+	t := newServiceTask(s)
+	te := task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     task.Start,
+		Timestatmp: time.Now(),
+		Task:       t,
+	}
+	m.addTask(&te)
+	log.Printf("Started task %v for revision %d of service %v\n", t.ID, s.Revision, s.Name)
+}
+
+// isHealthy reports whether the task is running and, if it has a health
+// check, passed it according to healthy.
+func isHealthy(t *task.Task, healthy map[uuid.UUID]bool) bool {
+	if t.FSM.Current() != task.Running {
+		return false
+	}
+	if t.HealthCheck == "" {
+		return true
+	}
+	return healthy[t.ID]
+}
+
+// serviceHealth runs the health checks of the running tasks that services
+// are being updated to. It takes m.mu only to find them, so that the API
+// is not held up while the checks run.
+func (m *Manager) serviceHealth() map[uuid.UUID]bool {
+	m.mu.Lock()
+	checks := []healthCheck{}
+	for _, t := range m.TaskDb {
+		s, ok := m.Services[t.Service]
+		if !ok || !s.updating() || t.ServiceRevision != s.Revision {
+			continue
+		}
+		if t.FSM.Current() == task.Running && t.HealthCheck != "" {
+			checks = append(checks, healthCheck{worker: m.TaskWorkerMap[t.ID], task: *t.Clone()})
+		}
+	}
+	m.mu.Unlock()
+
+	healthy := make(map[uuid.UUID]bool)
+	for _, c := range checks {
+		healthy[c.task.ID] = m.checkTaskHealth(c.worker, &c.task) == nil
+	}
+	return healthy
+}
+
+// reconcileService starts or stops tasks so that the number of active tasks
+// of the service matches its replica count. Tasks that failed no longer
+// count and get replaced; lost tasks are rescheduled by the manager. While
+// tasks from an older revision remain, it rolls them over to the current one
+// instead, using healthy for the results of health checks.
+func (m *Manager) reconcileService(s *Service, healthy map[uuid.UUID]bool) {
+	if s.UpdateStatus == UpdatePaused {
+		return
+	}
+
+	current := []*task.Task{}
+	old := []*task.Task{}
+	failed := 0
+	for _, t := range m.serviceTasks(s.Name) {
+		if t.ServiceRevision == s.Revision && t.FSM.Current() == task.Failed &&
+			s.updating() && t.StartTime.After(s.UpdateStartedTime) {
+			failed++
+		}
+		if !isActive(t) {
+			continue
+		}
+		if t.ServiceRevision == s.Revision {
+			current = append(current, t)
+		} else {
+			old = append(old, t)
+		}
+	}
+
+	if len(old) == 0 {
+		if s.updating() {
+			s.UpdateStatus = UpdateCompleted
+			m.saveService(s)
+			log.Printf("Service %v is now at revision %d\n", s.Name, s.Revision)
+		}
+		m.scaleService(s, current)
+		return
+	}
+
+	if failed > 0 {
+		s.UpdateStatus = UpdatePaused
+		s.UpdateMessage = fmt.Sprintf("%d tasks of revision %d failed", failed, s.Revision)
+		m.saveService(s)
+		log.Printf("Paused update of service %v: %s\n", s.Name, s.UpdateMessage)
+		return
+	}
+
+	m.rollService(s, current, old, healthy)
+}
+
+// scaleService starts or stops tasks of the current revision to match the
+// replica count.
+func (m *Manager) scaleService(s *Service, active []*task.Task) {
+	switch {
+	case len(active) < s.Replicas:
+		for i := len(active); i < s.Replicas; i++ {
+			m.startServiceTask(s)
+		}
+	case len(active) > s.Replicas:
+		// Cancel the tasks still waiting to be placed on a worker first,
+		// as they serve nothing yet, then stop the most recently started
+		// ones. Pending or lost tasks that are on their way to a worker
+		// cannot be stopped and are left for a later round.
+		sort.SliceStable(active, func(i, j int) bool {
+			pi, pj := m.TaskWorkerMap[active[i].ID] == "", m.TaskWorkerMap[active[j].ID] == ""
+			if pi != pj {
+				return pi
+			}
+			return active[i].StartTime.After(active[j].StartTime)
+		})
+		excess := len(active) - s.Replicas
+		for _, t := range active {
+			if excess == 0 {
+				break
+			}
+			state := t.FSM.Current()
+			if (state == task.Pending || state == task.Lost) && m.TaskWorkerMap[t.ID] != "" {
+				continue
+			}
+			m.stopTask(t)
+			log.Printf("Stopped task %v of service %v\n", t.ID, s.Name)
+			excess--
+		}
+	}
+}
+
+// rollService takes one step of a rolling update. Old tasks are stopped only
+// while enough healthy tasks remain to stay within MaxUnavailable, and new
+// tasks are started only while the total stays within MaxSurge.
+func (m *Manager) rollService(s *Service, current []*task.Task, old []*task.Task,
+	healthy map[uuid.UUID]bool) {
+	available := 0
+	for _, t := range current {
+		if isHealthy(t, healthy) {
+			available++
+		}
+	}
+	for _, t := range old {
+		if t.FSM.Current() == task.Running {
+			available++
+		}
+	}
+	minAvailable := s.Replicas - s.UpdateConfig.MaxUnavailable
+
+	remaining := 0
+	stopping := make(map[uuid.UUID]bool)
+	for _, t := range old {
+		switch t.FSM.Current() {
+		case task.Scheduled:
+			// Not serving yet, so stopping it costs nothing.
+			if !s.stopping[t.ID] {
+				m.stopTask(t)
+			}
+			stopping[t.ID] = true
+		case task.Running:
+			if available-1 < minAvailable {
+				remaining++
+				continue
+			}
+			m.stopTask(t)
+			available--
+		default:
+			remaining++
+		}
+	}
+
+	s.stopping = stopping
+
+	total := len(current) + remaining
+	for i := len(current); i < s.Replicas && total < s.Replicas+s.UpdateConfig.MaxSurge; i++ {
+		m.startServiceTask(s)
+		total++
+	}
+}
+
+func (m *Manager) reconcileServices() {
+	healthy := m.serviceHealth()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.Services {
+		m.reconcileService(s, healthy)
+	}
+}
+
+func (m *Manager) ReconcileServices() {
+	for {
+		log.Println("Reconciling services")
+		m.reconcileServices()
+		log.Println("Service reconciliation completed")
+		time.Sleep(m.Intervals.Reconcile)
+	}
+}
@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Yuya9786/cube/task"
+)
+
+// settle sends what the manager queued, waits for the worker to act on it
+// and has the manager pick up the result.
+func settle(t *testing.T, m *Manager, w *testWorker) {
+	t.Helper()
+	sendQueued(m)
+	waitFor(t, "the worker to settle", func() bool {
+		if w.Queue.Len() > 0 {
+			return false
+		}
+		for _, tk := range w.GetTasks() {
+			if tk.FSM.Current() == task.Scheduled {
+				return false
+			}
+		}
+		return true
+	})
+	m.updateTasks()
+}
+
+// activeTasks returns the active tasks of a service by revision.
+func activeTasks(m *Manager, name string) map[int]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revisions := make(map[int]int)
+	for _, t := range m.serviceTasks(name) {
+		if isActive(t) {
+			revisions[t.ServiceRevision]++
+		}
+	}
+	return revisions
+}
+
+// rollOut reconciles the service until its update is no longer in
+// progress, checking that it never has more tasks than MaxSurge allows.
+func rollOut(t *testing.T, m *Manager, w *testWorker, name string) *Service {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		m.reconcileServices()
+		s, err := m.GetService(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, n := range activeTasks(m, name) {
+			total += n
+		}
+		if max := s.Replicas + s.UpdateConfig.MaxSurge; total > max {
+			t.Fatalf("%d active tasks, want at most %d", total, max)
+		}
+		if !s.updating() {
+			return s
+		}
+		settle(t, m, w)
+	}
+	t.Fatal("update did not finish")
+	return nil
+}
+
+func newTestService(t *testing.T, m *Manager, w *testWorker) {
+	t.Helper()
+	s := &Service{Name: "web", Template: task.Task{Image: "web:1"}, Replicas: 2}
+	if err := m.AddService(s); err != nil {
+		t.Fatal(err)
+	}
+	m.reconcileServices()
+	settle(t, m, w)
+	if got := activeTasks(m, "web"); got[1] != 2 {
+		t.Fatalf("active tasks by revision are %v, want 2 of revision 1", got)
+	}
+}
+
+func updateImage(t *testing.T, m *Manager, image string) {
+	t.Helper()
+	s := &Service{Name: "web", Template: task.Task{Image: image}, Replicas: 2}
+	if err := m.UpdateService(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollingUpdate(t *testing.T) {
+	m, w := newTestManager(t)
+	newTestService(t, m, w)
+
+	updateImage(t, m, "web:2")
+	s := rollOut(t, m, w, "web")
+	if s.UpdateStatus != UpdateCompleted || s.Revision != 2 {
+		t.Fatalf("update is %v at revision %d, want it completed at 2", s.UpdateStatus, s.Revision)
+	}
+	settle(t, m, w)
+	if got := activeTasks(m, "web"); got[2] != 2 || got[1] != 0 {
+		t.Errorf("active tasks by revision are %v, want 2 of revision 2", got)
+	}
+}
+
+func TestRollingUpdateStopsScheduledTaskOnce(t *testing.T) {
+	m, w := newTestManager(t)
+	newTestService(t, m, w)
+
+	// One more task of revision 1 is still Scheduled as far as the
+	// manager knows when the update starts.
+	m.mu.Lock()
+	m.startServiceTask(m.Services["web"])
+	m.mu.Unlock()
+	sendQueued(m)
+	updateImage(t, m, "web:2")
+
+	stops := 0
+	for i := 0; i < 3; i++ {
+		m.reconcileServices()
+		for m.Pending.Len() > 0 {
+			te, _ := m.dequeue()
+			if te.Action == task.Stop {
+				stops++
+			}
+			m.Pending.Done(te)
+		}
+	}
+	if stops != 1 {
+		t.Errorf("scheduled task asked to stop %d times, want once", stops)
+	}
+}
+
+func TestRollingUpdatePauseAndRollback(t *testing.T) {
+	m, w := newTestManager(t)
+	newTestService(t, m, w)
+
+	updateImage(t, m, "web:broken")
+	m.reconcileServices()
+	w.Fake.FailNext("start", errors.New("no such image"))
+	settle(t, m, w)
+
+	s := rollOut(t, m, w, "web")
+	if s.UpdateStatus != UpdatePaused || s.UpdateMessage == "" {
+		t.Fatalf("update is %v with message %q, want it paused", s.UpdateStatus, s.UpdateMessage)
+	}
+	if got := activeTasks(m, "web"); got[1] != 2 {
+		t.Fatalf("active tasks by revision are %v, want the 2 of revision 1 kept", got)
+	}
+
+	if err := m.RollbackService("web"); err != nil {
+		t.Fatal(err)
+	}
+	s = rollOut(t, m, w, "web")
+	if s.UpdateStatus != UpdateCompleted || s.Revision != 1 || s.Template.Image != "web:1" {
+		t.Fatalf("update is %v at revision %d with image %s, want it rolled back to revision 1",
+			s.UpdateStatus, s.Revision, s.Template.Image)
+	}
+	if got := activeTasks(m, "web"); got[1] != 2 || got[2] != 0 {
+		t.Errorf("active tasks by revision are %v, want 2 of revision 1", got)
+	}
+}
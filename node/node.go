@@ -1,13 +1,62 @@
 package node
 
+import (
+	"strings"
+	"time"
+)
+
+// Node statuses
+const (
+	Unknown   = "Unknown"
+	Ready     = "Ready"
+	Unhealthy = "Unhealthy"
+	Down      = "Down"
+)
+
+// Scheduling statuses. Only Schedulable nodes get new tasks; a Draining
+// node also has its tasks moved elsewhere.
+const (
+	Schedulable = "Schedulable"
+	Cordoned    = "Cordoned"
+	Draining    = "Draining"
+)
+
+// Node is the manager's view of a worker machine. Cores and CpuAllocated are
+// in CPUs, Memory and Disk in bytes; the *Allocated fields are the sums
+// requested by tasks placed on the node, while the *Used fields are what the
+// worker last reported in use.
 type Node struct {
 	Name            string
 	Ip              string
+	Api             string
 	Cores           int
+	CpuAllocated    float64
 	Memory          int
 	MemoryAllocated int
+	MemoryUsed      int
 	Disk            int
 	DiskAllocated   int
+	DiskUsed        int
+	CpuUsage        float64
 	Role            string
+	Status          string
+	Scheduling      string
 	TaskCount       int
+	UsedPorts       []int
+	LastUpdated     time.Time
+}
+
+func NewNode(name string, api string, role string) *Node {
+	ip := name
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		ip = name[:i]
+	}
+	return &Node{
+		Name:       name,
+		Ip:         ip,
+		Api:        api,
+		Role:       role,
+		Status:     Unknown,
+		Scheduling: Schedulable,
+	}
 }
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"math"
+
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+)
+
+// LIEB is the base used by E-PVM to turn the utilization of a resource into
+// its marginal cost.
+const LIEB = 1.53960071783900203869
+
+// Epvm implements the Enhanced Parallel Virtual Machine cost model: each node
+// is scored by how much placing the task there would increase the cost of its
+// memory and task slots, and the cheapest node wins.
+type Epvm struct {
+	Name string
+}
+
+func (e *Epvm) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectFittingNodes(t, nodes)
+}
+
+func (e *Epvm) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		memCost := marginalCost(
+			float64(n.MemoryAllocated),
+			float64(n.MemoryAllocated)+float64(t.Memory),
+			float64(n.Memory))
+
+		slots := float64(n.Cores)
+		if slots < 1 {
+			slots = 1
+		}
+		taskCost := marginalCost(
+			float64(n.TaskCount),
+			float64(n.TaskCount+1),
+			slots)
+
+		nodeScores[n.Name] = memCost + taskCost
+	}
+	return nodeScores
+}
+
+func (e *Epvm) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
+
+func marginalCost(before, after, total float64) float64 {
+	return math.Pow(LIEB, ratio(after, total)) - math.Pow(LIEB, ratio(before, total))
+}
@@ -0,0 +1,35 @@
+package scheduler
+
+import (
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+)
+
+// LeastLoaded places a task on the node with the lowest share of its memory
+// and disk already allocated, using the task count per core as a tie breaker.
+type LeastLoaded struct {
+	Name string
+}
+
+func (l *LeastLoaded) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectFittingNodes(t, nodes)
+}
+
+func (l *LeastLoaded) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	for _, n := range nodes {
+		memLoad := ratio(float64(n.MemoryAllocated), float64(n.Memory))
+		diskLoad := ratio(float64(n.DiskAllocated), float64(n.Disk))
+		cores := n.Cores
+		if cores < 1 {
+			cores = 1
+		}
+		taskLoad := float64(n.TaskCount) / float64(cores)
+		nodeScores[n.Name] = memLoad + diskLoad + taskLoad
+	}
+	return nodeScores
+}
+
+func (l *LeastLoaded) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
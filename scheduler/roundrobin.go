@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+)
+
+// RoundRobin hands tasks to nodes in turn, ignoring their load.
+type RoundRobin struct {
+	Name       string
+	LastWorker int
+}
+
+func (r *RoundRobin) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return selectFittingNodes(t, nodes)
+}
+
+func (r *RoundRobin) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	nodeScores := make(map[string]float64)
+	if len(nodes) == 0 {
+		return nodeScores
+	}
+
+	var newWorker int
+	if r.LastWorker+1 < len(nodes) {
+		newWorker = r.LastWorker + 1
+		r.LastWorker++
+	} else {
+		newWorker = 0
+		r.LastWorker = 0
+	}
+
+	for idx, n := range nodes {
+		if idx == newWorker {
+			nodeScores[n.Name] = 0.1
+		} else {
+			nodeScores[n.Name] = 1.0
+		}
+	}
+
+	return nodeScores
+}
+
+func (r *RoundRobin) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
@@ -1,7 +1,76 @@
 package scheduler
 
+import (
+	"github.com/Yuya9786/cube/node"
+	"github.com/Yuya9786/cube/task"
+)
+
 type Scheduler interface {
-	SelectCandidateNodes()
-	Score()
-	Pick()
+	SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node
+	Score(t task.Task, nodes []*node.Node) map[string]float64
+	Pick(scores map[string]float64, candidates []*node.Node) *node.Node
+}
+
+// checkResources reports whether the node has enough unallocated CPU,
+// memory and disk left for the task. Nodes whose capacity has not been
+// reported yet only fit tasks that request nothing.
+func checkResources(t task.Task, n *node.Node) bool {
+	if float64(n.Cores)-n.CpuAllocated < t.Cpu {
+		return false
+	}
+	if int64(n.Memory-n.MemoryAllocated) < t.Memory {
+		return false
+	}
+	if int64(n.Disk-n.DiskAllocated) < t.DiskRequest() {
+		return false
+	}
+	return true
+}
+
+// checkPorts reports whether none of the host ports the task asks for by
+// number are already taken on the node.
+func checkPorts(t task.Task, n *node.Node) bool {
+	for _, want := range t.RequestedHostPorts() {
+		for _, used := range n.UsedPorts {
+			if want == used {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func selectFittingNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	var candidates []*node.Node
+	for _, n := range nodes {
+		if checkResources(t, n) && checkPorts(t, n) {
+			candidates = append(candidates, n)
+		}
+	}
+	return candidates
+}
+
+// pickLowest returns the candidate with the lowest score. Ties are broken by
+// the order of candidates so that the result does not depend on map iteration.
+func pickLowest(scores map[string]float64, candidates []*node.Node) *node.Node {
+	var best *node.Node
+	var lowest float64
+	for _, n := range candidates {
+		score, ok := scores[n.Name]
+		if !ok {
+			continue
+		}
+		if best == nil || score < lowest {
+			best = n
+			lowest = score
+		}
+	}
+	return best
+}
+
+func ratio(used, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return used / total
 }
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// OpenBolt opens (creating if needed) a BoltDB file. The returned DB can back
+// several BoltStores, one per bucket.
+func OpenBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %v: %w", path, err)
+	}
+	return db, nil
+}
+
+// BoltStore keeps JSON encoded values in a single bucket of a BoltDB file.
+type BoltStore[T any] struct {
+	Db     *bolt.DB
+	Bucket string
+}
+
+func NewBoltStore[T any](db *bolt.DB, bucket string) (*BoltStore[T], error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create bucket %v: %w", bucket, err)
+	}
+
+	return &BoltStore[T]{
+		Db:     db,
+		Bucket: bucket,
+	}, nil
+}
+
+func (s *BoltStore[T]) Put(key string, value T) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal %v: %w", key, err)
+	}
+
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).Put([]byte(key), buf)
+	})
+}
+
+func (s *BoltStore[T]) Get(key string) (T, error) {
+	var value T
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte(s.Bucket)).Get([]byte(key))
+		if buf == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(buf, &value)
+	})
+	return value, err
+}
+
+func (s *BoltStore[T]) Delete(key string) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore[T]) List() ([]T, error) {
+	values := []T{}
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).ForEach(func(k, v []byte) error {
+			var value T
+			if err := json.Unmarshal(v, &value); err != nil {
+				return fmt.Errorf("Unable to unmarshal %s: %w", k, err)
+			}
+			values = append(values, value)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Close closes the underlying DB, which is shared by every BoltStore opened
+// on it.
+func (s *BoltStore[T]) Close() error {
+	return s.Db.Close()
+}
@@ -0,0 +1,53 @@
+package store
+
+import "sync"
+
+type InMemoryStore[T any] struct {
+	mu sync.RWMutex
+	Db map[string]T
+}
+
+func NewInMemoryStore[T any]() *InMemoryStore[T] {
+	return &InMemoryStore[T]{
+		Db: make(map[string]T),
+	}
+}
+
+func (s *InMemoryStore[T]) Put(key string, value T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Db[key] = value
+	return nil
+}
+
+func (s *InMemoryStore[T]) Get(key string) (T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.Db[key]
+	if !ok {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *InMemoryStore[T]) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Db, key)
+	return nil
+}
+
+func (s *InMemoryStore[T]) List() ([]T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := []T{}
+	for _, v := range s.Db {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (s *InMemoryStore[T]) Close() error {
+	return nil
+}
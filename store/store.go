@@ -0,0 +1,14 @@
+package store
+
+import "errors"
+
+var ErrNotFound = errors.New("key not found")
+
+// Store persists values of type T under string keys.
+type Store[T any] interface {
+	Put(key string, value T) error
+	Get(key string) (T, error)
+	Delete(key string) error
+	List() ([]T, error)
+	Close() error
+}
@@ -0,0 +1,437 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+type Docker struct {
+	Client *client.Client
+}
+
+func NewDocker() (*Docker, error) {
+	dc, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{
+		Client: dc,
+	}, nil
+}
+
+func (d *Docker) Run(config Config) RuntimeResult {
+	ctx := context.Background()
+	reader, err := d.Client.ImagePull(
+		ctx, config.Image, types.ImagePullOptions{})
+	if err != nil {
+		log.Printf("Error pulling image %s: %v\n", config.Image, err)
+		return RuntimeResult{Error: err}
+	}
+	io.Copy(os.Stdout, reader)
+
+	rp := container.RestartPolicy{
+		Name: config.RestartPolicy,
+	}
+
+	r := container.Resources{
+		Memory:   config.Memory,
+		NanoCPUs: int64(config.Cpu * math.Pow(10, 9)),
+	}
+
+	mounts, err := d.prepareMounts(ctx, config)
+	if err != nil {
+		return RuntimeResult{Error: err}
+	}
+
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	if len(mounts) > 0 {
+		labels[VolumeRetentionLabel] = config.VolumeRetention
+	}
+
+	exposedPorts := nat.PortSet{}
+	for p := range config.ExposedPorts {
+		exposedPorts[p] = struct{}{}
+	}
+	for p := range config.PortBindings {
+		exposedPorts[p] = struct{}{}
+	}
+
+	cc := container.Config{
+		Image:        config.Image,
+		Tty:          false,
+		Entrypoint:   config.Entrypoint,
+		Cmd:          config.Cmd,
+		Env:          config.Env,
+		WorkingDir:   config.WorkingDir,
+		User:         config.User,
+		ExposedPorts: exposedPorts,
+		Labels:       labels,
+	}
+
+	hc := container.HostConfig{
+		RestartPolicy:   rp,
+		Resources:       r,
+		PublishAllPorts: len(config.PortBindings) == 0,
+		PortBindings:    config.PortBindings,
+		Mounts:          mounts,
+	}
+
+	resp, err := d.Client.ContainerCreate(
+		ctx, &cc, &hc, nil, nil, config.Name)
+	if err != nil {
+		log.Printf("Error creating container using image %s: %v\n", config.Image, err)
+		return RuntimeResult{Error: err}
+	}
+
+	if err := d.Client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		log.Printf("Error starting container %s: %v\n", resp.ID, err)
+		// Nothing refers to the container once the task has failed, so
+		// it would be left behind.
+		d.Remove(resp.ID)
+		return RuntimeResult{Error: err}
+	}
+
+	return RuntimeResult{ContainerId: resp.ID, Action: "start", Result: "success"}
+}
+
+// prepareMounts turns the task's mounts into Docker mounts, creating any
+// named volume that does not exist yet.
+func (d *Docker) prepareMounts(ctx context.Context, config Config) ([]mount.Mount, error) {
+	mounts := []mount.Mount{}
+	for _, m := range config.Mounts {
+		dm := mount.Mount{
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+
+		switch m.Type {
+		case MountVolume:
+			dm.Type = mount.TypeVolume
+			_, err := d.Client.VolumeCreate(ctx, volumetypes.VolumeCreateBody{
+				Name:   m.Source,
+				Labels: map[string]string{TaskIDLabel: config.Labels[TaskIDLabel]},
+			})
+			if err != nil {
+				log.Printf("Error creating volume %s: %v\n", m.Source, err)
+				return nil, err
+			}
+		case MountBind:
+			dm.Type = mount.TypeBind
+		case MountTmpfs:
+			dm.Type = mount.TypeTmpfs
+			dm.Source = ""
+			dm.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: m.Size}
+		default:
+			return nil, fmt.Errorf("Unknown mount type %q for %s", m.Type, m.Target)
+		}
+
+		mounts = append(mounts, dm)
+	}
+	return mounts, nil
+}
+
+func (d *Docker) Stop(id string) RuntimeResult {
+	log.Printf("Attempting to stop container %v", id)
+	ctx := context.Background()
+
+	var volumes []string
+	resp, err := d.Client.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Printf("Error inspecting container %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+	if resp.Config.Labels[VolumeRetentionLabel] == DeleteVolumes {
+		for _, m := range resp.Mounts {
+			if m.Type == mount.TypeVolume {
+				volumes = append(volumes, m.Name)
+			}
+		}
+	}
+
+	if err := d.Client.ContainerStop(ctx, id, nil); err != nil {
+		log.Printf("Error stopping container %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+
+	removeOptions := types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		RemoveLinks:   false,
+		Force:         false,
+	}
+
+	if err := d.Client.ContainerRemove(ctx, id, removeOptions); err != nil {
+		log.Printf("Error removing container %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+
+	for _, v := range volumes {
+		if err := d.Client.VolumeRemove(ctx, v, false); err != nil {
+			log.Printf("Error removing volume %s: %v\n", v, err)
+		}
+	}
+
+	return RuntimeResult{ContainerId: id, Action: "stop", Result: "success"}
+}
+
+// Remove forcibly removes a container, stopping it first if it is running.
+func (d *Docker) Remove(id string) RuntimeResult {
+	ctx := context.Background()
+	removeOptions := types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	}
+	if err := d.Client.ContainerRemove(ctx, id, removeOptions); err != nil {
+		log.Printf("Error removing container %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+
+	return RuntimeResult{ContainerId: id, Action: "remove", Result: "success"}
+}
+
+// ListTasks returns every container, running or not, that carries a task ID
+// label.
+func (d *Docker) ListTasks() ([]TaskContainer, error) {
+	ctx := context.Background()
+	containers, err := d.Client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", TaskIDLabel)),
+	})
+	if err != nil {
+		log.Printf("Error listing containers: %v\n", err)
+		return nil, err
+	}
+
+	tasks := []TaskContainer{}
+	for _, c := range containers {
+		id, err := uuid.Parse(c.Labels[TaskIDLabel])
+		if err != nil {
+			log.Printf("Container %v has an invalid task label: %v\n", c.ID, err)
+			continue
+		}
+		tasks = append(tasks, TaskContainer{ID: c.ID, TaskID: id, Status: c.State})
+	}
+	return tasks, nil
+}
+
+func (d *Docker) Restart(id string) RuntimeResult {
+	log.Printf("Attempting to restart container %v", id)
+	ctx := context.Background()
+	if err := d.Client.ContainerRestart(ctx, id, nil); err != nil {
+		log.Printf("Error restarting container %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+
+	return RuntimeResult{ContainerId: id, Action: "restart", Result: "success"}
+}
+
+func (d *Docker) Inspect(id string) InspectResponse {
+	ctx := context.Background()
+	resp, err := d.Client.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Printf("Error inspecting container %v, %v\n", id, err)
+		return InspectResponse{Error: err}
+	}
+
+	state := ContainerState{
+		Status:    resp.State.Status,
+		ExitCode:  resp.State.ExitCode,
+		OOMKilled: resp.State.OOMKilled,
+	}
+	if resp.State.Health != nil {
+		state.Health = resp.State.Health.Status
+	}
+	if resp.NetworkSettings != nil {
+		state.HostPorts = resp.NetworkSettings.Ports
+	}
+
+	return InspectResponse{State: &state}
+}
+
+// Logs returns the selected streams of the container's output interleaved
+// into a single stream. Closing it stops a followed stream.
+func (d *Docker) Logs(id string, opts LogOptions) (io.ReadCloser, error) {
+	lo := types.ContainerLogsOptions{
+		ShowStdout: opts.Stdout || !opts.Stderr,
+		ShowStderr: opts.Stderr || !opts.Stdout,
+		Follow:     opts.Follow,
+	}
+	if !opts.Since.IsZero() {
+		lo.Since = fmt.Sprintf("%d.%09d", opts.Since.Unix(), opts.Since.Nanosecond())
+	}
+	if opts.Tail > 0 {
+		lo.Tail = strconv.Itoa(opts.Tail)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := d.Client.ContainerLogs(ctx, id, lo)
+	if err != nil {
+		cancel()
+		log.Printf("Error getting logs for container %s: %v\n", id, err)
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, out)
+		out.Close()
+		pw.CloseWithError(err)
+	}()
+
+	return logReader{PipeReader: pr, cancel: cancel}, nil
+}
+
+// logReader is the reading end of a log stream that ends the stream when
+// it is closed.
+type logReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r logReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+// Exec runs a command in the container through a Docker exec instance.
+func (d *Docker) Exec(id string, config ExecConfig, streams ExecStreams) (int, error) {
+	ctx := context.Background()
+	exec, err := d.Client.ContainerExecCreate(ctx, id, types.ExecConfig{
+		User:         config.User,
+		Tty:          config.Tty,
+		AttachStdin:  config.Stdin,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          config.Env,
+		WorkingDir:   config.WorkingDir,
+		Cmd:          config.Cmd,
+	})
+	if err != nil {
+		log.Printf("Error creating exec in container %s: %v\n", id, err)
+		return 0, err
+	}
+
+	resp, err := d.Client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: config.Tty})
+	if err != nil {
+		log.Printf("Error starting exec %s in container %s: %v\n", exec.ID, id, err)
+		return 0, err
+	}
+	defer resp.Close()
+
+	if config.Stdin && streams.Stdin != nil {
+		go func() {
+			io.Copy(resp.Conn, streams.Stdin)
+			resp.CloseWrite()
+		}()
+	}
+	if config.Tty && streams.Resize != nil {
+		go func() {
+			for size := range streams.Resize {
+				err := d.Client.ContainerExecResize(ctx, exec.ID, types.ResizeOptions{
+					Height: size.Height,
+					Width:  size.Width,
+				})
+				if err != nil {
+					log.Printf("Error resizing terminal of exec %s: %v\n", exec.ID, err)
+				}
+			}
+		}()
+	}
+
+	// Without a terminal Docker multiplexes stdout and stderr.
+	if config.Tty {
+		_, err = io.Copy(streams.Stdout, resp.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(streams.Stdout, streams.Stderr, resp.Reader)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := d.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		log.Printf("Error inspecting exec %s: %v\n", exec.ID, err)
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// WatchEvents follows the Docker daemon's events for containers carrying a
+// task ID label.
+func (d *Docker) WatchEvents(ctx context.Context) (<-chan ContainerEvent, <-chan error) {
+	f := filters.NewArgs(
+		filters.Arg("type", events.ContainerEventType),
+		filters.Arg("label", TaskIDLabel),
+	)
+	for _, action := range []string{ContainerDied, ContainerOOM, ContainerHealth, ContainerDestroyed} {
+		f.Add("event", action)
+	}
+	msgs, errs := d.Client.Events(ctx, types.EventsOptions{Filters: f})
+
+	out := make(chan ContainerEvent)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				e, ok := containerEvent(msg)
+				if !ok {
+					continue
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, errs
+}
+
+// containerEvent translates a Docker event. Health events come with the new
+// status in the action, e.g. "health_status: unhealthy".
+func containerEvent(msg events.Message) (ContainerEvent, bool) {
+	id, err := uuid.Parse(msg.Actor.Attributes[TaskIDLabel])
+	if err != nil {
+		return ContainerEvent{}, false
+	}
+
+	e := ContainerEvent{
+		ContainerId: msg.Actor.ID,
+		TaskID:      id,
+		Action:      msg.Action,
+		Time:        time.Unix(0, msg.TimeNano),
+	}
+	switch {
+	case msg.Action == ContainerDied:
+		e.ExitCode, _ = strconv.Atoi(msg.Actor.Attributes["exitCode"])
+	case strings.HasPrefix(msg.Action, ContainerHealth):
+		e.Action = ContainerHealth
+		e.Health = strings.TrimSpace(strings.TrimPrefix(msg.Action, ContainerHealth+":"))
+	}
+	return e, true
+}
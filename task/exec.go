@@ -0,0 +1,117 @@
+package task
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Execer is implemented by runtimes that can run commands inside a task's
+// container, e.g. a shell for debugging.
+type Execer interface {
+	// Exec runs config.Cmd in the container and returns its exit code once
+	// it has exited and all of its output has been written to streams.
+	Exec(id string, config ExecConfig, streams ExecStreams) (int, error)
+}
+
+// ExecConfig is a command to run in a task's container. With Stdin the
+// command reads from ExecStreams.Stdin; with Tty it runs on a terminal,
+// which merges its stdout and stderr.
+type ExecConfig struct {
+	Cmd        []string
+	Env        []string
+	User       string
+	WorkingDir string
+	Stdin      bool
+	Tty        bool
+}
+
+// ExecStreams connect a command run by Exec. Resize carries changes of the
+// terminal's size when the command runs on one.
+type ExecStreams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Resize <-chan TerminalSize
+}
+
+type TerminalSize struct {
+	Height uint
+	Width  uint
+}
+
+// Exec sessions are carried over an upgraded HTTP connection as frames: a
+// byte with the frame type, the length of the payload as four big-endian
+// bytes, and the payload. Stdin, ExecResize and ExecCloseStdin frames go
+// to the command; output, ExecExit and ExecError frames come back from it.
+// The exit code and resize payloads are encoded as JSON.
+const (
+	ExecStdin byte = iota
+	ExecStdout
+	ExecStderr
+	ExecError
+	ExecExit
+	ExecResize
+	ExecCloseStdin
+)
+
+// ExecUpgrade is the protocol exec requests ask to upgrade to.
+const ExecUpgrade = "cube-exec"
+
+const maxFrameSize = 1 << 20
+
+// WriteFrame writes one frame of an exec session.
+func WriteFrame(w io.Writer, kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// ReadFrame reads one frame of an exec session.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("Exec frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// FrameWriter writes everything written to it as frames of one type to W.
+// Writers sharing a connection have to share Mu.
+type FrameWriter struct {
+	W    io.Writer
+	Kind byte
+	Mu   *sync.Mutex
+}
+
+func (f FrameWriter) Write(b []byte) (int, error) {
+	for written := 0; written < len(b); {
+		n := len(b) - written
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		f.Mu.Lock()
+		err := WriteFrame(f.W, f.Kind, b[written:written+n])
+		f.Mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(b), nil
+}
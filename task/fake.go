@@ -0,0 +1,268 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fake is a Runtime for tests that keeps simulated containers in memory
+// instead of running anything. Containers start out running and stay that
+// way until Exit is called; failures can be injected per action with
+// FailNext. As with Docker, no two containers may have the same name.
+// Exiting, stopping and removing containers is reported to event watchers.
+type Fake struct {
+	mu         sync.Mutex
+	Containers map[string]*FakeContainer
+	failures   map[string]error
+	watchers   map[chan ContainerEvent]bool
+}
+
+type FakeContainer struct {
+	ID       string
+	Config   Config
+	Status   string
+	ExitCode int
+	Output   []string
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		Containers: make(map[string]*FakeContainer),
+		failures:   make(map[string]error),
+		watchers:   make(map[chan ContainerEvent]bool),
+	}
+}
+
+// FailNext makes the next call for action ("start", "stop", "restart",
+// "inspect" or "exec") return err.
+func (f *Fake) FailNext(action string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[action] = err
+}
+
+// Exit simulates the container's process exiting with code.
+func (f *Fake) Exit(id string, code int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.Containers[id]
+	if !ok {
+		return fmt.Errorf("No such container: %s", id)
+	}
+	c.Status = "exited"
+	c.ExitCode = code
+	c.Output = append(c.Output, fmt.Sprintf("exited with code %d", code))
+	f.publish(c, ContainerDied)
+	return nil
+}
+
+// Write appends a line to the container's output.
+func (f *Fake) Write(id string, line string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.Containers[id]
+	if !ok {
+		return fmt.Errorf("No such container: %s", id)
+	}
+	c.Output = append(c.Output, line)
+	return nil
+}
+
+func (f *Fake) takeFailure(action string) error {
+	err := f.failures[action]
+	delete(f.failures, action)
+	return err
+}
+
+func (f *Fake) Run(config Config) RuntimeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("start"); err != nil {
+		return RuntimeResult{Error: err}
+	}
+	for _, c := range f.Containers {
+		if config.Name != "" && c.Config.Name == config.Name {
+			return RuntimeResult{Error: fmt.Errorf("Conflict. The container name %q is already in use by container %s", config.Name, c.ID)}
+		}
+	}
+
+	c := &FakeContainer{
+		ID:     uuid.NewString(),
+		Config: config,
+		Status: "running",
+	}
+	f.Containers[c.ID] = c
+
+	return RuntimeResult{ContainerId: c.ID, Action: "start", Result: "success"}
+}
+
+func (f *Fake) Stop(id string) RuntimeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("stop"); err != nil {
+		return RuntimeResult{Error: err}
+	}
+	c, ok := f.Containers[id]
+	if !ok {
+		return RuntimeResult{Error: fmt.Errorf("No such container: %s", id)}
+	}
+	delete(f.Containers, id)
+	f.publish(c, ContainerDied)
+	f.publish(c, ContainerDestroyed)
+
+	return RuntimeResult{ContainerId: id, Action: "stop", Result: "success"}
+}
+
+func (f *Fake) Remove(id string) RuntimeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.Containers[id]; ok {
+		delete(f.Containers, id)
+		f.publish(c, ContainerDestroyed)
+	}
+	return RuntimeResult{ContainerId: id, Action: "remove", Result: "success"}
+}
+
+func (f *Fake) Restart(id string) RuntimeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("restart"); err != nil {
+		return RuntimeResult{Error: err}
+	}
+	c, ok := f.Containers[id]
+	if !ok {
+		return RuntimeResult{Error: fmt.Errorf("No such container: %s", id)}
+	}
+	c.Status = "running"
+	c.ExitCode = 0
+
+	return RuntimeResult{ContainerId: id, Action: "restart", Result: "success"}
+}
+
+func (f *Fake) Inspect(id string) InspectResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("inspect"); err != nil {
+		return InspectResponse{Error: err}
+	}
+	c, ok := f.Containers[id]
+	if !ok {
+		return InspectResponse{Error: fmt.Errorf("No such container: %s", id)}
+	}
+
+	return InspectResponse{State: &ContainerState{
+		Status:   c.Status,
+		ExitCode: c.ExitCode,
+	}}
+}
+
+// Logs returns the output written so far. It all counts as stdout; Follow
+// and Since are ignored.
+func (f *Fake) Logs(id string, opts LogOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.Containers[id]
+	if !ok {
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+
+	lines := c.Output
+	if opts.Stderr && !opts.Stdout {
+		lines = nil
+	}
+	if opts.Tail > 0 && len(lines) > opts.Tail {
+		lines = lines[len(lines)-opts.Tail:]
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return io.NopCloser(strings.NewReader(b.String())), nil
+}
+
+// Exec simulates a command that echoes the command line and then copies
+// its stdin to stdout. The container's exit code is returned.
+func (f *Fake) Exec(id string, config ExecConfig, streams ExecStreams) (int, error) {
+	f.mu.Lock()
+	if err := f.takeFailure("exec"); err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	c, ok := f.Containers[id]
+	if !ok {
+		f.mu.Unlock()
+		return 0, fmt.Errorf("No such container: %s", id)
+	}
+	code := c.ExitCode
+	f.mu.Unlock()
+
+	fmt.Fprintln(streams.Stdout, strings.Join(config.Cmd, " "))
+	if config.Stdin && streams.Stdin != nil {
+		if _, err := io.Copy(streams.Stdout, streams.Stdin); err != nil {
+			return 0, err
+		}
+	}
+	return code, nil
+}
+
+func (f *Fake) ListTasks() ([]TaskContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tasks := []TaskContainer{}
+	for _, c := range f.Containers {
+		id, err := uuid.Parse(c.Config.Labels[TaskIDLabel])
+		if err != nil {
+			continue
+		}
+		tasks = append(tasks, TaskContainer{ID: c.ID, TaskID: id, Status: c.Status})
+	}
+	return tasks, nil
+}
+
+func (f *Fake) WatchEvents(ctx context.Context) (<-chan ContainerEvent, <-chan error) {
+	events := make(chan ContainerEvent, 100)
+	f.mu.Lock()
+	f.watchers[events] = true
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.watchers, events)
+		f.mu.Unlock()
+	}()
+
+	return events, make(chan error)
+}
+
+// publish sends an event about c to every watcher. Watchers that fall
+// behind miss it.
+func (f *Fake) publish(c *FakeContainer, action string) {
+	id, err := uuid.Parse(c.Config.Labels[TaskIDLabel])
+	if err != nil {
+		return
+	}
+	e := ContainerEvent{
+		ContainerId: c.ID,
+		TaskID:      id,
+		Action:      action,
+		Time:        time.Now(),
+	}
+	if action == ContainerDied {
+		e.ExitCode = c.ExitCode
+	}
+	for w := range f.watchers {
+		select {
+		case w <- e:
+		default:
+		}
+	}
+}
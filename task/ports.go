@@ -0,0 +1,59 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// ParsePortBinding parses one entry of Task.PortBindings, which maps
+// container ports to the host ports they should be published on. The
+// container port may omit its protocol, in which case tcp is assumed. The
+// host side is either empty (any port from the worker's range), a single
+// port, or a range written "min-max"; min and max are 0 in the first case.
+func ParsePortBinding(containerPort string, hostSpec string) (nat.Port, int, int, error) {
+	proto, port := nat.SplitProtoPort(containerPort)
+	if !strings.Contains(containerPort, "/") {
+		proto = "tcp"
+	}
+	p, err := nat.NewPort(proto, port)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("Invalid container port %q: %w", containerPort, err)
+	}
+
+	min, max, err := nat.ParsePortRangeToInt(hostSpec)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("Invalid host port %q for %s: %w", hostSpec, p, err)
+	}
+
+	return p, min, max, nil
+}
+
+// RequestedHostPorts returns the host ports the task asks for by number.
+// Ports requested as a range are not included.
+func (t Task) RequestedHostPorts() []int {
+	ports := []int{}
+	for containerPort, hostSpec := range t.PortBindings {
+		_, min, max, err := ParsePortBinding(containerPort, hostSpec)
+		if err != nil || min == 0 || min != max {
+			continue
+		}
+		ports = append(ports, min)
+	}
+	return ports
+}
+
+// AllocatedHostPorts returns the host ports the task has been given.
+func (t Task) AllocatedHostPorts() []int {
+	ports := []int{}
+	for _, bindings := range t.HostPorts {
+		for _, b := range bindings {
+			p, err := nat.ParsePort(b.HostPort)
+			if err == nil && p != 0 {
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports
+}
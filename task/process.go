@@ -0,0 +1,565 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const cgroupV2Root = "/sys/fs/cgroup"
+
+// adoptedPollInterval is how often a process adopted from an earlier run of
+// the worker is checked for having exited.
+const adoptedPollInterval = time.Second
+
+// Process is a Runtime that runs tasks as local OS processes rather than
+// containers. Config.Entrypoint followed by Config.Cmd gives the executable
+// and its arguments, Config.Env is added to the worker's environment and
+// Config.WorkingDir and Config.User are honored when set. Output goes to a
+// log file per process under Dir, next to a state file from which the
+// processes are adopted again when the worker restarts. When cgroups v2 is
+// mounted, each process is placed in its own cgroup under CgroupDir with
+// its CPU and memory limits applied.
+type Process struct {
+	mu        sync.Mutex
+	Dir       string
+	CgroupDir string
+	procs     map[string]*process
+}
+
+type process struct {
+	id        string
+	config    Config
+	cmd       *exec.Cmd
+	pid       int
+	startTime string
+	logPath   string
+	status    string
+	exitCode  int
+	done      chan struct{}
+}
+
+// processState is what the state file of a process holds. StartTime is the
+// start time the kernel gives the process, which tells it apart from a later
+// process that got the same pid.
+type processState struct {
+	ID        string
+	Config    Config
+	Pid       int
+	StartTime string
+	Status    string
+	ExitCode  int
+}
+
+func NewProcess(dir string) (*Process, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create %v: %w", dir, err)
+	}
+
+	p := &Process{
+		Dir:   dir,
+		procs: make(map[string]*process),
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupV2Root, "cgroup.controllers")); err == nil {
+		cgroupDir := filepath.Join(cgroupV2Root, "cube")
+		// Controllers have to be enabled on the parent before child
+		// cgroups can set their limits.
+		control := filepath.Join(cgroupDir, "cgroup.subtree_control")
+		if err := os.MkdirAll(cgroupDir, 0755); err != nil {
+			log.Printf("Unable to create cgroup %v, running processes without limits: %v\n", cgroupDir, err)
+		} else if err := os.WriteFile(control, []byte("+cpu +memory"), 0644); err != nil {
+			log.Printf("Unable to enable controllers in cgroup %v, running processes without limits: %v\n", cgroupDir, err)
+		} else {
+			p.CgroupDir = cgroupDir
+		}
+	} else {
+		log.Println("cgroups v2 not available, running processes without limits")
+	}
+
+	if err := p.adopt(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Process) statePath(id string) string {
+	return filepath.Join(p.Dir, id+".json")
+}
+
+// save writes the state file of a process. p.mu must be held.
+func (p *Process) save(proc *process) {
+	data, err := json.Marshal(processState{
+		ID:        proc.id,
+		Config:    proc.config,
+		Pid:       proc.pid,
+		StartTime: proc.startTime,
+		Status:    proc.status,
+		ExitCode:  proc.exitCode,
+	})
+	if err == nil {
+		tmp := p.statePath(proc.id) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, p.statePath(proc.id))
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving state of process %v: %v\n", proc.id, err)
+	}
+}
+
+// adopt loads the processes recorded in the state files under Dir. Those
+// still running are watched until they exit; as they are no longer children
+// of the worker, their exit code is only known if the worker reaps them,
+// and is -1 otherwise.
+func (p *Process) adopt() error {
+	paths, err := filepath.Glob(filepath.Join(p.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read process state: %w", err)
+		}
+		st := processState{}
+		if err := json.Unmarshal(data, &st); err != nil {
+			log.Printf("Skipping invalid process state %v: %v\n", path, err)
+			continue
+		}
+
+		proc := &process{
+			id:        st.ID,
+			config:    st.Config,
+			pid:       st.Pid,
+			startTime: st.StartTime,
+			logPath:   filepath.Join(p.Dir, st.ID+".log"),
+			status:    st.Status,
+			exitCode:  st.ExitCode,
+			done:      make(chan struct{}),
+		}
+		p.procs[proc.id] = proc
+
+		if st.Status != "running" {
+			close(proc.done)
+			continue
+		}
+		if st.StartTime == "" || processStartTime(st.Pid) != st.StartTime {
+			log.Printf("Process %v exited while the worker was down\n", proc.id)
+			proc.status = "exited"
+			proc.exitCode = -1
+			p.save(proc)
+			close(proc.done)
+			continue
+		}
+		log.Printf("Adopting process %v with pid %d\n", proc.id, proc.pid)
+		go p.watch(proc, proc.done)
+	}
+	return nil
+}
+
+// watch waits for an adopted process to exit.
+func (p *Process) watch(proc *process, done chan struct{}) {
+	code := -1
+	for {
+		var ws syscall.WaitStatus
+		if pid, _ := syscall.Wait4(proc.pid, &ws, syscall.WNOHANG, nil); pid == proc.pid {
+			// The worker inherited the process, e.g. by running as
+			// pid 1, and has to reap it.
+			code = ws.ExitStatus()
+			break
+		}
+		if processStartTime(proc.pid) != proc.startTime {
+			break
+		}
+		time.Sleep(adoptedPollInterval)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	proc.status = "exited"
+	proc.exitCode = code
+	p.save(proc)
+	close(done)
+}
+
+// processStartTime returns the start time of a process in clock ticks since
+// boot, or "" if there is no process with the pid or it has exited and is
+// waiting to be reaped.
+func processStartTime(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// The command name in parentheses may contain spaces; the fields
+	// after it start with the state, which is field 3.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 || fields[0] == "Z" || fields[0] == "X" {
+		return ""
+	}
+	return fields[19]
+}
+
+func (p *Process) Run(config Config) RuntimeResult {
+	if len(config.Entrypoint)+len(config.Cmd) == 0 {
+		return RuntimeResult{Error: errors.New("No command given for process")}
+	}
+	if len(config.Mounts) > 0 {
+		return RuntimeResult{Error: errors.New("Mounts are not supported by the process runtime")}
+	}
+
+	proc := &process{
+		id:     uuid.NewString(),
+		config: config,
+	}
+	proc.logPath = filepath.Join(p.Dir, proc.id+".log")
+
+	if err := p.start(proc); err != nil {
+		log.Printf("Error starting process for %v: %v\n", config.Name, err)
+		return RuntimeResult{Error: err}
+	}
+
+	p.mu.Lock()
+	p.procs[proc.id] = proc
+	p.mu.Unlock()
+
+	return RuntimeResult{ContainerId: proc.id, Action: "start", Result: "success"}
+}
+
+func (p *Process) start(proc *process) error {
+	out, err := os.OpenFile(proc.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file: %w", err)
+	}
+
+	argv := append(append([]string{}, proc.config.Entrypoint...), proc.config.Cmd...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), proc.config.Env...)
+	cmd.Dir = proc.config.WorkingDir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if proc.config.User != "" {
+		cred, err := lookupCredential(proc.config.User)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if p.CgroupDir != "" {
+		if err := p.limit(proc.id, cmd.Process.Pid, proc.config); err != nil {
+			log.Printf("Error applying limits to process %v: %v\n", proc.id, err)
+		}
+	}
+
+	p.mu.Lock()
+	proc.cmd = cmd
+	proc.pid = cmd.Process.Pid
+	proc.startTime = processStartTime(proc.pid)
+	proc.status = "running"
+	proc.exitCode = 0
+	proc.done = make(chan struct{})
+	done := proc.done
+	p.save(proc)
+	p.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		out.Close()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		proc.status = "exited"
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			proc.exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			proc.exitCode = -1
+		}
+		p.save(proc)
+		close(done)
+	}()
+
+	return nil
+}
+
+// lookupCredential resolves a user given as a name, a uid, or "user:group".
+func lookupCredential(spec string) (*syscall.Credential, error) {
+	name, group, _ := strings.Cut(spec, ":")
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("Unknown user %v", name)
+		}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("Unknown group %v", group)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// limit moves the process into its own cgroup and applies the CPU and memory
+// limits from config.
+func (p *Process) limit(id string, pid int, config Config) error {
+	dir := filepath.Join(p.CgroupDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if config.Memory > 0 {
+		memMax := strconv.FormatInt(config.Memory, 10)
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memMax), 0644); err != nil {
+			return err
+		}
+	}
+
+	if config.Cpu > 0 {
+		period := 100000
+		cpuMax := fmt.Sprintf("%d %d", int(config.Cpu*float64(period)), period)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0644); err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// terminate sends SIGTERM to the process group and escalates to SIGKILL if it
+// has not exited after ten seconds.
+func (p *Process) terminate(proc *process) {
+	p.mu.Lock()
+	pid, done, status := proc.pid, proc.done, proc.status
+	p.mu.Unlock()
+	if status != "running" {
+		return
+	}
+
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-done
+	}
+}
+
+func (p *Process) lookup(id string) (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	proc, ok := p.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("No such process: %s", id)
+	}
+	return proc, nil
+}
+
+func (p *Process) Stop(id string) RuntimeResult {
+	log.Printf("Attempting to stop process %v", id)
+	proc, err := p.lookup(id)
+	if err != nil {
+		return RuntimeResult{Error: err}
+	}
+
+	p.terminate(proc)
+
+	p.mu.Lock()
+	delete(p.procs, id)
+	p.mu.Unlock()
+
+	if p.CgroupDir != "" {
+		os.Remove(filepath.Join(p.CgroupDir, id))
+	}
+	os.Remove(proc.logPath)
+	os.Remove(p.statePath(id))
+
+	return RuntimeResult{ContainerId: id, Action: "stop", Result: "success"}
+}
+
+func (p *Process) Remove(id string) RuntimeResult {
+	result := p.Stop(id)
+	result.Action = "remove"
+	return result
+}
+
+func (p *Process) Restart(id string) RuntimeResult {
+	log.Printf("Attempting to restart process %v", id)
+	proc, err := p.lookup(id)
+	if err != nil {
+		return RuntimeResult{Error: err}
+	}
+
+	p.terminate(proc)
+	if err := p.start(proc); err != nil {
+		log.Printf("Error restarting process %s: %v\n", id, err)
+		return RuntimeResult{Error: err}
+	}
+
+	return RuntimeResult{ContainerId: id, Action: "restart", Result: "success"}
+}
+
+func (p *Process) Inspect(id string) InspectResponse {
+	proc, err := p.lookup(id)
+	if err != nil {
+		return InspectResponse{Error: err}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return InspectResponse{State: &ContainerState{
+		Status:   proc.status,
+		ExitCode: proc.exitCode,
+	}}
+}
+
+// followInterval is how often a followed log file is checked for new
+// output.
+const followInterval = 250 * time.Millisecond
+
+// Logs returns the process's output. Stdout and stderr share one log file
+// without timestamps, so a single stream and Since cannot be selected.
+func (p *Process) Logs(id string, opts LogOptions) (io.ReadCloser, error) {
+	if opts.Stdout != opts.Stderr {
+		return nil, fmt.Errorf("%w: the process runtime does not keep stdout and stderr apart", ErrLogOptionUnsupported)
+	}
+	if !opts.Since.IsZero() {
+		return nil, fmt.Errorf("%w: the process runtime does not record when output was written", ErrLogOptionUnsupported)
+	}
+
+	proc, err := p.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	done := proc.done
+	p.mu.Unlock()
+
+	f, err := os.Open(proc.logPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tail > 0 {
+		if err := seekTail(f, opts.Tail); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if !opts.Follow {
+		return f, nil
+	}
+	return &followReader{f: f, done: done, closed: make(chan struct{})}, nil
+}
+
+// seekTail positions f at the start of its last n lines.
+func seekTail(f *os.File, n int) error {
+	starts := make([]int64, 0, n+1)
+	var offset int64
+	atLineStart := true
+	buf := make([]byte, 32*1024)
+	for {
+		c, err := f.Read(buf)
+		for _, b := range buf[:c] {
+			if atLineStart {
+				if len(starts) == n {
+					starts = starts[1:]
+				}
+				starts = append(starts, offset)
+			}
+			offset++
+			atLineStart = b == '\n'
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	start := offset
+	if len(starts) > 0 {
+		start = starts[0]
+	}
+	_, err := f.Seek(start, io.SeekStart)
+	return err
+}
+
+// followReader reads a log file as it grows until the process has exited
+// and everything it wrote has been read, or until the reader is closed.
+type followReader struct {
+	f      *os.File
+	done   <-chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *followReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.f.Read(b)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-r.done:
+			// Pick up whatever was written before the process exited.
+			return r.f.Read(b)
+		case <-r.closed:
+			return 0, io.EOF
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+func (r *followReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return r.f.Close()
+}
+
+func (p *Process) ListTasks() ([]TaskContainer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := []TaskContainer{}
+	for _, proc := range p.procs {
+		id, err := uuid.Parse(proc.config.Labels[TaskIDLabel])
+		if err != nil {
+			continue
+		}
+		tasks = append(tasks, TaskContainer{ID: proc.id, TaskID: id, Status: proc.status})
+	}
+	return tasks, nil
+}
@@ -0,0 +1,183 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// Names a task can use in Task.Runtime to pick the runtime it runs on. An
+// empty name means the worker's default runtime.
+const (
+	RuntimeDocker  = "docker"
+	RuntimeProcess = "process"
+)
+
+// Runtime runs the containers backing tasks. Containers are referred to by
+// the ID the runtime returned from Run, which the worker keeps in
+// Task.ContainerId.
+type Runtime interface {
+	Run(config Config) RuntimeResult
+	Stop(id string) RuntimeResult
+	Restart(id string) RuntimeResult
+	Inspect(id string) InspectResponse
+	Logs(id string, opts LogOptions) (io.ReadCloser, error)
+}
+
+// LogOptions select the output Runtime.Logs returns. With Follow the stream
+// stays open for new output until the container stops or the reader is
+// closed. Output written before Since is left out, and when Tail is above
+// zero only that many of the last lines are returned. Stdout and Stderr
+// pick the streams; when neither is set both are returned.
+type LogOptions struct {
+	Follow bool
+	Since  time.Time
+	Tail   int
+	Stdout bool
+	Stderr bool
+}
+
+// ErrLogOptionUnsupported is returned by Logs for options the runtime
+// cannot honor.
+var ErrLogOptionUnsupported = errors.New("log option not supported by the runtime")
+
+// ParseSince parses the start of a log window, given either as an RFC 3339
+// timestamp or as a duration back from now, e.g. "10m".
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since %q is neither a duration nor an RFC 3339 timestamp", s)
+	}
+	return t, nil
+}
+
+// Query encodes the options as the query parameters of the logs endpoints:
+// follow, since, tail, stdout and stderr.
+func (o LogOptions) Query() url.Values {
+	q := url.Values{}
+	if o.Follow {
+		q.Set("follow", "true")
+	}
+	if !o.Since.IsZero() {
+		q.Set("since", o.Since.Format(time.RFC3339Nano))
+	}
+	if o.Tail > 0 {
+		q.Set("tail", strconv.Itoa(o.Tail))
+	}
+	if o.Stdout {
+		q.Set("stdout", "true")
+	}
+	if o.Stderr {
+		q.Set("stderr", "true")
+	}
+	return q
+}
+
+// ParseLogOptions decodes the query parameters written by Query. Since may
+// also be a duration back from now.
+func ParseLogOptions(q url.Values) (LogOptions, error) {
+	opts := LogOptions{}
+	for name, field := range map[string]*bool{
+		"follow": &opts.Follow,
+		"stdout": &opts.Stdout,
+		"stderr": &opts.Stderr,
+	} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return LogOptions{}, fmt.Errorf("%s %q is not a boolean", name, v)
+			}
+			*field = b
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := ParseSince(v, time.Now())
+		if err != nil {
+			return LogOptions{}, err
+		}
+		opts.Since = since
+	}
+	if v := q.Get("tail"); v != "" && v != "all" {
+		tail, err := strconv.Atoi(v)
+		if err != nil || tail < 0 {
+			return LogOptions{}, fmt.Errorf("tail %q is not a number of lines", v)
+		}
+		opts.Tail = tail
+	}
+	return opts, nil
+}
+
+// TaskLister is implemented by runtimes that can enumerate the containers
+// they have created for tasks, which lets the worker reconcile its records
+// after a restart.
+type TaskLister interface {
+	ListTasks() ([]TaskContainer, error)
+	Remove(id string) RuntimeResult
+}
+
+// EventWatcher is implemented by runtimes that report what happens to task
+// containers as it happens, which saves the worker from polling them.
+type EventWatcher interface {
+	// WatchEvents streams events of task containers until ctx is done.
+	// If the stream breaks, an error is sent on the error channel.
+	WatchEvents(ctx context.Context) (<-chan ContainerEvent, <-chan error)
+}
+
+// Container event actions
+const (
+	ContainerDied      = "die"
+	ContainerOOM       = "oom"
+	ContainerHealth    = "health_status"
+	ContainerDestroyed = "destroy"
+)
+
+// ContainerEvent is something that happened to a task's container. ExitCode
+// is set for ContainerDied and Health for ContainerHealth events.
+type ContainerEvent struct {
+	ContainerId string
+	TaskID      uuid.UUID
+	Action      string
+	ExitCode    int
+	Health      string
+	Time        time.Time
+}
+
+type RuntimeResult struct {
+	Error       error
+	Action      string
+	ContainerId string
+	Result      string
+}
+
+// ContainerState is what a runtime reports about a task's container.
+// Status uses Docker's vocabulary: "created", "running", "paused",
+// "restarting", "exited" or "dead". Health is the status of the container's
+// own health check, if it has one.
+type ContainerState struct {
+	Status    string
+	ExitCode  int
+	OOMKilled bool
+	Health    string
+	HostPorts nat.PortMap
+}
+
+type InspectResponse struct {
+	Error error
+	State *ContainerState
+}
+
+type TaskContainer struct {
+	ID     string
+	TaskID uuid.UUID
+	Status string
+}
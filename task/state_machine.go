@@ -9,6 +9,7 @@ const (
 	Running          = "Running"
 	Completed        = "Completed"
 	Failed           = "Failed"
+	Lost             = "Lost"
 )
 
 // Action
@@ -18,6 +19,7 @@ const (
 	Stop     string = "Stop"
 	Fail     string = "Fail"
 	Restart  string = "Restart"
+	Lose     string = "Lose"
 )
 
 func NewFSM() *fsm.FSM {
@@ -29,6 +31,7 @@ func NewFSM() *fsm.FSM {
 			{Name: Stop, Src: []string{Running}, Dst: Completed},
 			{Name: Fail, Src: []string{Scheduled, Running}, Dst: Failed},
 			{Name: Restart, Src: []string{Running, Completed, Failed}, Dst: Running},
+			{Name: Lose, Src: []string{Scheduled, Running}, Dst: Lost},
 		},
 		fsm.Callbacks{},
 	)
@@ -1,206 +1,212 @@
 package task
 
 import (
-	"context"
-	"io"
-	"log"
-	"math"
-	"os"
+	"bytes"
+	"encoding/json"
+	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 	"github.com/looplab/fsm"
 )
 
-type Task struct {
-	ID            uuid.UUID
-	ContainerId   string
-	Name          string
-	FSM           *fsm.FSM
-	Image         string
-	Cpu           float64
-	Memory        int64
-	Disk          int64
-	ExposedPorts  nat.PortSet
-	HostPorts     nat.PortMap
-	PortBindings  map[string]string
-	RestartPolicy string
-	StartTime     time.Time
-	FinishTime    time.Time
-	HealthCheck   string
-	RestartCount  int
-}
-
-/*
- TasksEvent is an internal object that
- our system uses to trigger tasks from
- one state to another
-*/
-type TaskEvent struct {
-	ID         uuid.UUID
-	Action     string
-	Timestatmp time.Time
-	Task       Task
-}
-
-type Config struct {
-	Name          string
-	AttachStdin   bool
-	AttachStdout  bool
-	AttachStderr  bool
-	ExposedPorts  nat.PortSet
-	Cmd           []string
-	Image         string
-	Cpu           float64
-	Memory        int64
-	Disk          int64
-	Env           []string
-	RestartPolicy string
-}
+// TaskIDLabel is the container label holding the ID of the task a container
+// was created for.
+const TaskIDLabel = "cube.task.id"
 
-func NewConfig(task *Task) *Config {
-	return &Config{
-		Name:          task.Name,
-		ExposedPorts:  task.ExposedPorts,
-		Image:         task.Image,
-		Cpu:           task.Cpu,
-		Memory:        task.Memory,
-		Disk:          task.Disk,
-		RestartPolicy: task.RestartPolicy,
-	}
-}
+// VolumeRetentionLabel is the container label holding the task's volume
+// retention policy, so that it is still known when the container is stopped.
+const VolumeRetentionLabel = "cube.volume.retention"
 
-type Docker struct {
-	Client *client.Client
-	Config Config
-}
+// Mount types
+const (
+	MountVolume = "volume"
+	MountBind   = "bind"
+	MountTmpfs  = "tmpfs"
+)
 
-func NewDocker(config *Config) (*Docker, error) {
-	dc, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return nil, err
-	}
-	return &Docker{
-		Client: dc,
-		Config: *config,
-	}, nil
-}
+// Volume retention policies, deciding what happens to a task's named
+// volumes once it is stopped. Volumes are retained by default.
+const (
+	RetainVolumes = "retain"
+	DeleteVolumes = "delete"
+)
 
-type DockerResult struct {
-	Error       error
-	Action      string
-	ContainerId string
-	Result      string
+// Mount attaches storage to a task. Source is the volume name for volume
+// mounts and the host path for bind mounts, and is unused for tmpfs. Size is
+// in bytes: for volumes it counts toward the task's disk request, for tmpfs
+// it caps the mount.
+type Mount struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool
+	Size     int64
 }
 
-type DockerInspectResponse struct {
-	Error     error
-	Container *types.ContainerJSON
+type Task struct {
+	ID              uuid.UUID
+	ContainerId     string
+	Name            string
+	Service         string
+	ServiceRevision int
+	State           string
+	FSM             *fsm.FSM `json:"-"`
+	Image           string
+	Runtime         string
+	Entrypoint      []string
+	Cmd             []string
+	Env             []string
+	WorkingDir      string
+	User            string
+	Cpu             float64
+	Memory          int64
+	Disk            int64
+	Mounts          []Mount
+	VolumeRetention string
+	ExposedPorts    nat.PortSet
+	HostPorts       nat.PortMap
+	PortBindings    map[string]string
+	RestartPolicy   string
+	StartTime       time.Time
+	FinishTime      time.Time
+	HealthCheck     string
+	RestartCount    int
+	PendingReason   string
+	ExitCode        int
+	OOMKilled       bool
+	Health          string
+	Error           string
+	Output          []string
 }
 
-func (d *Docker) Run() DockerResult {
-	ctx := context.Background()
-	reader, err := d.Client.ImagePull(
-		ctx, d.Config.Image, types.ImagePullOptions{})
-	if err != nil {
-		log.Printf("Error pulling image %s: %v\n", d.Config.Image, err)
-		return DockerResult{Error: err}
-	}
-	io.Copy(os.Stdout, reader)
-
-	rp := container.RestartPolicy{
-		Name: d.Config.RestartPolicy,
+// DiskRequest is the disk the task needs: its own Disk request plus the
+// size of every volume it mounts.
+func (t Task) DiskRequest() int64 {
+	disk := t.Disk
+	for _, m := range t.Mounts {
+		if m.Type == MountVolume {
+			disk += m.Size
+		}
 	}
+	return disk
+}
 
-	r := container.Resources{
-		Memory:   d.Config.Memory,
-		NanoCPUs: int64(d.Config.Cpu * math.Pow(10, 9)),
+// ContainerName is the name the task's container is given. Container
+// names are unique while task names are not, e.g. a manifest task and the
+// task replacing it run side by side for a while, so it ends in the short
+// form of the task's ID. Service tasks have that in their name already.
+func (t Task) ContainerName() string {
+	short := t.ID.String()[:8]
+	if t.Name == "" || strings.HasSuffix(t.Name, "-"+short) {
+		return t.Name
 	}
+	return t.Name + "-" + short
+}
 
-	cc := container.Config{
-		Image:        d.Config.Image,
-		Tty:          false,
-		Env:          d.Config.Env,
-		ExposedPorts: d.Config.ExposedPorts,
+// Clone returns a copy of the task with a state machine of its own, so that
+// the copy can change state without affecting t.
+func (t *Task) Clone() *Task {
+	c := *t
+	if t.FSM != nil {
+		c.FSM = NewFSM()
+		c.FSM.SetState(t.FSM.Current())
 	}
+	return &c
+}
 
-	hc := container.HostConfig{
-		RestartPolicy:   rp,
-		Resources:       r,
-		PublishAllPorts: true,
-	}
+// taskJSON has the fields of Task without its JSON methods.
+type taskJSON Task
 
-	resp, err := d.Client.ContainerCreate(
-		ctx, &cc, &hc, nil, nil, d.Config.Name)
-	if err != nil {
-		log.Printf("Error creating container using image %s: %v\n", d.Config.Image, err)
-		return DockerResult{Error: err}
+// MarshalJSON encodes the task with State set to the current state of its
+// FSM, which cannot be serialized itself.
+func (t Task) MarshalJSON() ([]byte, error) {
+	if t.FSM != nil {
+		t.State = t.FSM.Current()
 	}
+	return json.Marshal(taskJSON(t))
+}
 
-	if err := d.Client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		log.Printf("Error starting container %s: %v\n", resp.ID, err)
-		return DockerResult{Error: err}
+// UnmarshalJSON decodes a task and rebuilds its FSM from State, defaulting
+// to Pending when no state was given. Unknown fields are rejected, as they
+// are most likely misspelled ones that would otherwise be dropped silently.
+func (t *Task) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var decoded taskJSON
+	if err := d.Decode(&decoded); err != nil {
+		return err
 	}
+	*t = Task(decoded)
 
-	out, err := d.Client.ContainerLogs(
-		ctx,
-		resp.ID,
-		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
-	if err != nil {
-		log.Printf("Error getting logs for container %s: %v\n", resp.ID, err)
-		return DockerResult{Error: err}
+	if t.State == "" {
+		t.State = Pending
 	}
+	t.FSM = NewFSM()
+	t.FSM.SetState(t.State)
 
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-
-	return DockerResult{ContainerId: resp.ID, Action: "start", Result: "success"}
+	return nil
 }
 
-func (d *Docker) Stop(id string) DockerResult {
-	log.Printf("Attempting to stop container %v", id)
-	ctx := context.Background()
-	if err := d.Client.ContainerStop(ctx, id, nil); err != nil {
-		log.Printf("Error stopping container %s: %v\n", id, err)
-		panic(err)
-	}
-
-	removeOptions := types.ContainerRemoveOptions{
-		RemoveVolumes: true,
-		RemoveLinks:   false,
-		Force:         false,
-	}
-
-	if err := d.Client.ContainerRemove(ctx, id, removeOptions); err != nil {
-		log.Printf("Error removing container %s: %v\n", id, err)
-		panic(err)
-	}
+/*
+TasksEvent is an internal object that
+our system uses to trigger tasks from
+one state to another
+*/
+type TaskEvent struct {
+	ID         uuid.UUID
+	Action     string
+	Timestatmp time.Time
+	Task       Task
+}
 
-	return DockerResult{ContainerId: id, Action: "stop", Result: "success"}
+type Config struct {
+	Name            string
+	AttachStdin     bool
+	AttachStdout    bool
+	AttachStderr    bool
+	ExposedPorts    nat.PortSet
+	PortBindings    nat.PortMap
+	Entrypoint      []string
+	Cmd             []string
+	Image           string
+	Cpu             float64
+	Memory          int64
+	Disk            int64
+	Mounts          []Mount
+	VolumeRetention string
+	Env             []string
+	WorkingDir      string
+	User            string
+	RestartPolicy   string
+	Labels          map[string]string
 }
 
-func (d *Docker) Restart(id string) DockerResult {
-	log.Printf("Attempting to restart container %v", id)
-	ctx := context.Background()
-	if err := d.Client.ContainerRestart(ctx, id, nil); err != nil {
-		log.Printf("Error stopping container %s: %v\n", id, err)
-		panic(err)
+func NewConfig(task *Task) *Config {
+	// Host ports are only fixed when the task asked for them; they have
+	// been allocated into HostPorts by the worker.
+	var portBindings nat.PortMap
+	if len(task.PortBindings) > 0 {
+		portBindings = task.HostPorts
 	}
 
-	return DockerResult{ContainerId: id, Action: "restart", Result: "success"}
-}
-func (d *Docker) Inspect(id string) DockerInspectResponse {
-	ctx := context.Background()
-	resp, err := d.Client.ContainerInspect(ctx, id)
-	if err != nil {
-		log.Printf("Error inspecting container %v, %v\n", id, err)
-		return DockerInspectResponse{Error: err}
+	return &Config{
+		Name:            task.ContainerName(),
+		ExposedPorts:    task.ExposedPorts,
+		PortBindings:    portBindings,
+		Image:           task.Image,
+		Entrypoint:      task.Entrypoint,
+		Cmd:             task.Cmd,
+		Env:             task.Env,
+		WorkingDir:      task.WorkingDir,
+		User:            task.User,
+		Cpu:             task.Cpu,
+		Memory:          task.Memory,
+		Disk:            task.Disk,
+		Mounts:          task.Mounts,
+		VolumeRetention: task.VolumeRetention,
+		RestartPolicy:   task.RestartPolicy,
+		Labels:          map[string]string{TaskIDLabel: task.ID.String()},
 	}
-
-	return DockerInspectResponse{Container: &resp}
-
 }
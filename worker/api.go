@@ -4,13 +4,11 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/Yuya9786/cube/httpapi"
 	"github.com/go-chi/chi/v5"
 )
 
-type ErrResponse struct {
-	HTTPStatusCode int
-	Message        string
-}
+type ErrResponse = httpapi.ErrResponse
 
 type Api struct {
 	Address string
@@ -26,6 +24,8 @@ func (a *Api) initRouter() {
 		r.Get("/", a.GetTasksHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", a.StopTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
 		})
 	})
 	a.Router.Route("/stats", func(r chi.Router) {
@@ -33,7 +33,13 @@ func (a *Api) initRouter() {
 	})
 }
 
-func (a *Api) Start() {
+// Handler returns the routes of the API, e.g. to serve them from a test
+// server.
+func (a *Api) Handler() http.Handler {
 	a.initRouter()
-	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
+	return a.Router
+}
+
+func (a *Api) Start() error {
+	return http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Handler())
 }
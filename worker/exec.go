@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTaskNotRunning   = errors.New("task is not running")
+	ErrExecNotSupported = errors.New("runtime does not support exec")
+)
+
+// execTarget returns the runtime and container to run a command in for a
+// running task.
+func (w *Worker) execTarget(id uuid.UUID) (task.Execer, string, error) {
+	t, ok := w.getTask(id)
+	if !ok {
+		return nil, "", ErrTaskNotFound
+	}
+	if t.FSM.Current() != task.Running || t.ContainerId == "" {
+		return nil, "", ErrTaskNotRunning
+	}
+
+	r, err := w.runtimeFor(t)
+	if err != nil {
+		return nil, "", err
+	}
+	ex, ok := r.(task.Execer)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %T", ErrExecNotSupported, r)
+	}
+	return ex, t.ContainerId, nil
+}
+
+// runExec runs a command in a container for an exec session whose frames
+// are read from r and written to conn. It closes conn once the command has
+// exited and its exit code has been sent.
+func (w *Worker) runExec(ex task.Execer, containerID string, config task.ExecConfig, conn net.Conn, r io.Reader) {
+	defer conn.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	resize := make(chan task.TerminalSize, 1)
+	go func() {
+		defer close(resize)
+		for {
+			kind, payload, err := task.ReadFrame(r)
+			if err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			switch kind {
+			case task.ExecStdin:
+				if config.Stdin {
+					stdinWriter.Write(payload)
+				}
+			case task.ExecCloseStdin:
+				stdinWriter.Close()
+			case task.ExecResize:
+				size := task.TerminalSize{}
+				if err := json.Unmarshal(payload, &size); err != nil {
+					continue
+				}
+				// Only the latest size matters.
+				select {
+				case <-resize:
+				default:
+				}
+				resize <- size
+			}
+		}
+	}()
+
+	mu := &sync.Mutex{}
+	streams := task.ExecStreams{
+		Stdin:  stdin,
+		Stdout: task.FrameWriter{W: conn, Kind: task.ExecStdout, Mu: mu},
+		Stderr: task.FrameWriter{W: conn, Kind: task.ExecStderr, Mu: mu},
+		Resize: resize,
+	}
+	log.Printf("Running %q in container %v\n", config.Cmd, containerID)
+	code, err := ex.Exec(containerID, config, streams)
+	// Unblock the frame reader if the command stopped reading its stdin.
+	stdin.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		log.Printf("Error running %q in container %v: %v\n", config.Cmd, containerID, err)
+		task.WriteFrame(conn, task.ExecError, []byte(err.Error()))
+		return
+	}
+	data, _ := json.Marshal(code)
+	task.WriteFrame(conn, task.ExecExit, data)
+}
@@ -2,11 +2,15 @@ package worker
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/Yuya9786/cube/httpapi"
 	"github.com/Yuya9786/cube/task"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -24,17 +28,17 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 	te := task.TaskEvent{}
 	if err := d.Decode(&te); err != nil {
-		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
-		log.Printf(msg)
-		w.WriteHeader(400)
-		e := ErrResponse{
-			HTTPStatusCode: 400,
-			Message:        msg,
-		}
-		json.NewEncoder(w).Encode(e)
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
 		return
 	}
 
+	if te.Action == task.Start {
+		if err := a.Worker.PrepareStart(&te.Task); err != nil {
+			httpapi.WriteError(w, 409, fmt.Sprintf("Error preparing to start task %v: %v\n", te.Task.ID, err))
+			return
+		}
+	}
+
 	a.Worker.AddTask(&te)
 	log.Printf("Added task %v\n", te.Task.ID)
 	w.WriteHeader(201)
@@ -46,13 +50,15 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if taskID == "" {
 		log.Printf("No taskID passed in request\n")
 		w.WriteHeader(400)
+		return
 	}
 
 	tID, _ := uuid.Parse(taskID)
-	taskToStop, ok := a.Worker.Db[tID]
+	taskToStop, ok := a.Worker.getTask(tID)
 	if !ok {
 		log.Printf("No task with ID %v found", tID)
 		w.WriteHeader(404)
+		return
 	}
 
 	te := task.TaskEvent{
@@ -71,5 +77,83 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 func (a *Api) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(a.Worker.Stats)
+	json.NewEncoder(w).Encode(a.Worker.currentStats())
+}
+
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	tID, _ := uuid.Parse(chi.URLParam(r, "taskID"))
+	opts, err := task.ParseLogOptions(r.URL.Query())
+	if err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Invalid log options: %v\n", err))
+		return
+	}
+
+	logs, err := a.Worker.TaskLogs(tID, opts)
+	if err != nil {
+		code := 500
+		switch {
+		case errors.Is(err, ErrTaskNotFound):
+			code = 404
+		case errors.Is(err, task.ErrLogOptionUnsupported):
+			code = 400
+		}
+		httpapi.WriteError(w, code, fmt.Sprintf("Error getting logs of task %v: %v\n", tID, err))
+		return
+	}
+	defer logs.Close()
+
+	// A followed stream only ends when the container stops, so close it
+	// when the client goes away.
+	go func() {
+		<-r.Context().Done()
+		logs.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	httpapi.CopyFlushing(w, logs)
+}
+
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, _ := uuid.Parse(chi.URLParam(r, "taskID"))
+	if !strings.EqualFold(r.Header.Get("Upgrade"), task.ExecUpgrade) {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Exec needs the connection upgraded to %s\n", task.ExecUpgrade))
+		return
+	}
+
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	config := task.ExecConfig{}
+	if err := d.Decode(&config); err != nil {
+		httpapi.WriteError(w, 400, fmt.Sprintf("Error unmarshalling body: %v\n", err))
+		return
+	}
+	if len(config.Cmd) == 0 {
+		httpapi.WriteError(w, 400, "No command given\n")
+		return
+	}
+
+	ex, containerID, err := a.Worker.execTarget(tID)
+	if err != nil {
+		code := 500
+		switch {
+		case errors.Is(err, ErrTaskNotFound):
+			code = 404
+		case errors.Is(err, ErrTaskNotRunning):
+			code = 409
+		case errors.Is(err, ErrExecNotSupported):
+			code = 400
+		}
+		httpapi.WriteError(w, code, fmt.Sprintf("Error running command in task %v: %v\n", tID, err))
+		return
+	}
+
+	io.Copy(io.Discard, r.Body)
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		httpapi.WriteError(w, 500, fmt.Sprintf("Error taking over connection: %v\n", err))
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", task.ExecUpgrade)
+	a.Worker.runExec(ex, containerID, config, conn, buf.Reader)
 }
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HeartbeatInterval is how often a worker reports to the manager.
+const HeartbeatInterval = 10 * time.Second
+
+// Registration is what a worker sends the manager to join the cluster. Name
+// is the host:port address the manager reaches the worker's API on.
+type Registration struct {
+	Name string
+}
+
+// Heartbeat is what a worker periodically sends the manager to show it is
+// alive.
+type Heartbeat struct {
+	Name  string
+	Stats *Stats
+}
+
+// SendHeartbeats registers the worker with the manager at managerUrl and
+// then keeps sending it heartbeats. If the manager no longer knows the
+// worker, e.g. because it was restarted, the worker registers again.
+func (w *Worker) SendHeartbeats(managerUrl string) {
+	registered := false
+	for {
+		if !registered {
+			if err := w.register(managerUrl); err != nil {
+				log.Printf("Error registering with manager %v: %v\n", managerUrl, err)
+			} else {
+				registered = true
+			}
+		}
+		if registered {
+			err := w.sendHeartbeat(managerUrl)
+			if err == errNotRegistered {
+				log.Printf("Manager %v does not know this worker, registering again\n", managerUrl)
+				registered = false
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending heartbeat to manager %v: %v\n", managerUrl, err)
+			}
+		}
+		time.Sleep(HeartbeatInterval)
+	}
+}
+
+var errNotRegistered = errors.New("Worker is not registered")
+
+func (w *Worker) register(managerUrl string) error {
+	reg := Registration{Name: w.Name}
+	resp, err := post(fmt.Sprintf("%s/nodes", managerUrl), reg)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Unexpected response %v", resp.Status)
+	}
+	log.Printf("Registered with manager %v as %v\n", managerUrl, w.Name)
+	return nil
+}
+
+func (w *Worker) sendHeartbeat(managerUrl string) error {
+	stats := w.currentStats()
+	if stats == nil {
+		stats = GetStats()
+		stats.TaskCount = w.runningTaskCount()
+	}
+	hb := Heartbeat{Name: w.Name, Stats: stats}
+	resp, err := post(fmt.Sprintf("%s/nodes/%s/heartbeat", managerUrl, w.Name), hb)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNotRegistered
+	}
+	return fmt.Errorf("Unexpected response %v", resp.Status)
+}
+
+func post(url string, v any) (*http.Response, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return http.Post(url, "application/json", bytes.NewBuffer(data))
+}
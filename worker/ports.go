@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// PortAllocator hands out host ports to tasks and remembers which task holds
+// each one, so that two tasks on the worker never get the same port.
+// Requests for any port are served from Min to Max.
+type PortAllocator struct {
+	Min  int
+	Max  int
+	mu   sync.Mutex
+	used map[int]uuid.UUID
+}
+
+func NewPortAllocator(min, max int) *PortAllocator {
+	return &PortAllocator{
+		Min:  min,
+		Max:  max,
+		used: make(map[int]uuid.UUID),
+	}
+}
+
+// Allocate picks host ports for every entry of the task's PortBindings.
+// Either all bindings are satisfied or none of the ports are taken.
+func (p *PortAllocator) Allocate(t *task.Task) (nat.PortMap, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	portMap := nat.PortMap{}
+	taken := []int{}
+	release := func() {
+		for _, port := range taken {
+			delete(p.used, port)
+		}
+	}
+
+	for containerPort, hostSpec := range t.PortBindings {
+		cp, min, max, err := task.ParsePortBinding(containerPort, hostSpec)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if min == 0 {
+			min, max = p.Min, p.Max
+		}
+
+		port, err := p.pick(cp.Proto(), min, max)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("Unable to bind %s: %w", cp, err)
+		}
+		p.used[port] = t.ID
+		taken = append(taken, port)
+		portMap[cp] = []nat.PortBinding{{HostPort: strconv.Itoa(port)}}
+	}
+
+	return portMap, nil
+}
+
+func (p *PortAllocator) pick(proto string, min, max int) (int, error) {
+	for port := min; port <= max; port++ {
+		if _, ok := p.used[port]; ok {
+			continue
+		}
+		if !hostPortFree(proto, port) {
+			continue
+		}
+		return port, nil
+	}
+	if min == max {
+		return 0, fmt.Errorf("host port %d is in use", min)
+	}
+	return 0, fmt.Errorf("no free host port between %d and %d", min, max)
+}
+
+// Reserve marks ports a task already holds as used, e.g. after a restart.
+func (p *PortAllocator) Reserve(id uuid.UUID, ports []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, port := range ports {
+		p.used[port] = id
+	}
+}
+
+// Claim gives a task back ports it held before, e.g. when a failed task is
+// restarted. It fails without taking any of them if another task holds one.
+func (p *PortAllocator) Claim(id uuid.UUID, ports []int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, port := range ports {
+		if holder, ok := p.used[port]; ok && holder != id {
+			return fmt.Errorf("host port %d is held by task %v", port, holder)
+		}
+	}
+	for _, port := range ports {
+		p.used[port] = id
+	}
+	return nil
+}
+
+// Release frees every port held by the task.
+func (p *PortAllocator) Release(id uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for port, holder := range p.used {
+		if holder == id {
+			delete(p.used, port)
+		}
+	}
+}
+
+func hostPortFree(proto string, port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+func portTask(bindings map[string]string) *task.Task {
+	return &task.Task{ID: uuid.New(), PortBindings: bindings}
+}
+
+func hostPort(t *testing.T, portMap nat.PortMap, containerPort nat.Port) int {
+	t.Helper()
+	bindings := portMap[containerPort]
+	if len(bindings) != 1 {
+		t.Fatalf("%s bound to %v, want one host port", containerPort, bindings)
+	}
+	port, err := strconv.Atoi(bindings[0].HostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestAllocateAnyPort(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+
+	first, err := p.Allocate(portTask(map[string]string{"80": ""}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Allocate(portTask(map[string]string{"80/tcp": ""}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := hostPort(t, first, "80/tcp"), hostPort(t, second, "80/tcp")
+	if a == b {
+		t.Errorf("both tasks got host port %d", a)
+	}
+	for _, port := range []int{a, b} {
+		if port < 31000 || port > 31999 {
+			t.Errorf("host port %d outside the worker's range", port)
+		}
+	}
+}
+
+func TestAllocateFixedPort(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+
+	portMap, err := p.Allocate(portTask(map[string]string{"53/udp": "31005"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := hostPort(t, portMap, "53/udp"); port != 31005 {
+		t.Errorf("got host port %d, want 31005", port)
+	}
+	if _, err := p.Allocate(portTask(map[string]string{"53/udp": "31005"})); err == nil {
+		t.Error("host port 31005 given to a second task")
+	}
+}
+
+func TestAllocatePortInUseOnHost(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	p := NewPortAllocator(31000, 31999)
+	if _, err := p.Allocate(portTask(map[string]string{"80": port})); err == nil {
+		t.Errorf("host port %s given out while another process listens on it", port)
+	}
+}
+
+func TestAllocateRange(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+	p.Reserve(uuid.New(), []int{31010})
+
+	portMap, err := p.Allocate(portTask(map[string]string{"80": "31010-31011"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := hostPort(t, portMap, "80/tcp"); port != 31011 {
+		t.Errorf("got host port %d, want 31011", port)
+	}
+	if _, err := p.Allocate(portTask(map[string]string{"80": "31010-31011"})); err == nil {
+		t.Error("port given out from an exhausted range")
+	}
+}
+
+func TestAllocateAllOrNothing(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+	p.Reserve(uuid.New(), []int{31001})
+
+	tk := portTask(map[string]string{"80": "31000", "443": "31001"})
+	if _, err := p.Allocate(tk); err == nil {
+		t.Fatal("expected an error")
+	}
+	if holder, ok := p.used[31000]; ok {
+		t.Errorf("host port 31000 kept by %v after the allocation failed", holder)
+	}
+}
+
+func TestAllocateInvalidBinding(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+	for _, bindings := range []map[string]string{
+		{"http": ""},
+		{"80": "web"},
+	} {
+		if _, err := p.Allocate(portTask(bindings)); err == nil {
+			t.Errorf("bindings %v accepted", bindings)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+	id, other := uuid.New(), uuid.New()
+	p.Reserve(id, []int{31000})
+
+	if err := p.Claim(id, []int{31000, 31001}); err != nil {
+		t.Fatal(err)
+	}
+	if p.used[31001] != id {
+		t.Errorf("host port 31001 held by %v, want %v", p.used[31001], id)
+	}
+
+	if err := p.Claim(other, []int{31002, 31001}); err == nil {
+		t.Fatal("port of another task claimed")
+	}
+	if _, ok := p.used[31002]; ok {
+		t.Error("host port 31002 taken although the claim failed")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	p := NewPortAllocator(31000, 31999)
+	id, other := uuid.New(), uuid.New()
+	p.Reserve(id, []int{31000, 31001})
+	p.Reserve(other, []int{31002})
+
+	p.Release(id)
+	if len(p.used) != 1 || p.used[31002] != other {
+		t.Errorf("ports held after release: %v", p.used)
+	}
+}
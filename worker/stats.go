@@ -2,6 +2,7 @@ package worker
 
 import (
 	"log"
+	"runtime"
 
 	"github.com/c9s/goprocinfo/linux"
 )
@@ -11,6 +12,7 @@ type Stats struct {
 	DiskStats *linux.Disk
 	CpuStats  *linux.CPUStat
 	LoadStats *linux.LoadAvg
+	Cores     int
 	TaskCount int
 }
 
@@ -60,6 +62,7 @@ func GetStats() *Stats {
 		DiskStats: GetDiskInfo(),
 		CpuStats:  GetCpuStats(),
 		LoadStats: GetLoadAvg(),
+		Cores:     runtime.NumCPU(),
 	}
 }
 
@@ -1,63 +1,390 @@
 package worker
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 
+	"github.com/Yuya9786/cube/store"
 	"github.com/Yuya9786/cube/task"
+	"github.com/Yuya9786/cube/workqueue"
 )
 
+// DefaultConcurrency is how many task operations a worker runs at once
+// unless told otherwise.
+const DefaultConcurrency = 4
+
 type Worker struct {
-	Name      string
-	Queue     queue.Queue
+	Name  string
+	Queue *workqueue.Queue[*task.TaskEvent]
+	// Concurrency is how many task operations RunTasks runs at once.
+	// Operations on the same task always run one after another.
+	Concurrency int
+
+	// mu guards Db, Stats, TaskCount and watching. The tasks in Db are never
+	// changed in place: they are copied, changed and put back, so that
+	// the API can encode them while task operations are running.
+	mu        sync.Mutex
 	Db        map[uuid.UUID]*task.Task
+	Store     store.Store[task.Task]
+	Runtime   task.Runtime
+	Runtimes  map[string]task.Runtime
+	Ports     *PortAllocator
 	TaskCount int
 	Stats     *Stats
+	Intervals Intervals
+
+	// watching holds the runtimes whose container events are being
+	// followed.
+	watching map[task.Runtime]bool
+}
+
+// Intervals are how long the worker's loops sleep between rounds. Tasks
+// are checked every Update unless their runtime reports container events,
+// in which case they are only checked every Resync in case events were
+// missed.
+type Intervals struct {
+	Update time.Duration
+	Stats  time.Duration
+	Resync time.Duration
+}
+
+var DefaultIntervals = Intervals{
+	Update: 15 * time.Second,
+	Stats:  15 * time.Second,
+	Resync: 5 * time.Minute,
+}
+
+// syncAction is the action of the task events the worker queues for itself
+// to bring a task up to date with its container. They go through the queue
+// so that they do not run while the task is being started or stopped.
+const syncAction = "Sync"
+
+// How long to wait before opening a broken container event stream again.
+const eventRetryInterval = 5 * time.Second
+
+// outputLines is how many of the last lines a failed task's container
+// wrote are kept in Task.Output.
+const outputLines = 20
+
+func taskKey(te *task.TaskEvent) string {
+	return te.Task.ID.String()
+}
+
+// New creates a worker that runs tasks on runtime unless they ask for one of
+// the named runtimes in Runtimes. When dbPath is empty its tasks only live in
+// memory; otherwise they are kept in a BoltDB file at dbPath and loaded from
+// it. Reconcile should be called afterwards to line the loaded tasks up with
+// the containers actually present.
+func New(name string, runtime task.Runtime, dbPath string) (*Worker, error) {
+	w := &Worker{
+		Name:        name,
+		Queue:       workqueue.New(taskKey),
+		Concurrency: DefaultConcurrency,
+		Db:          make(map[uuid.UUID]*task.Task),
+		Runtime:     runtime,
+		Runtimes:    make(map[string]task.Runtime),
+		Ports:       NewPortAllocator(30000, 32767),
+		Intervals:   DefaultIntervals,
+		watching:    make(map[task.Runtime]bool),
+	}
+
+	if dbPath == "" {
+		w.Store = store.NewInMemoryStore[task.Task]()
+		return w, nil
+	}
+
+	db, err := store.OpenBolt(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if w.Store, err = store.NewBoltStore[task.Task](db, "tasks"); err != nil {
+		return nil, err
+	}
+
+	tasks, err := w.Store.List()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load tasks: %w", err)
+	}
+	for i := range tasks {
+		t := &tasks[i]
+		w.Db[t.ID] = t
+		switch t.FSM.Current() {
+		case task.Completed, task.Failed:
+		default:
+			w.Ports.Reserve(t.ID, t.AllocatedHostPorts())
+		}
+	}
+	log.Printf("Loaded %d tasks\n", len(tasks))
+
+	return w, nil
+}
+
+func (w *Worker) Close() error {
+	return w.Store.Close()
+}
+
+// allRuntimes returns every runtime of the worker once.
+func (w *Worker) allRuntimes() []task.Runtime {
+	runtimes := []task.Runtime{w.Runtime}
+	seen := map[task.Runtime]bool{w.Runtime: true}
+	for _, r := range w.Runtimes {
+		if !seen[r] {
+			seen[r] = true
+			runtimes = append(runtimes, r)
+		}
+	}
+	return runtimes
+}
+
+func (w *Worker) runtimeFor(t *task.Task) (task.Runtime, error) {
+	if t.Runtime == "" {
+		return w.Runtime, nil
+	}
+	r, ok := w.Runtimes[t.Runtime]
+	if !ok {
+		return nil, fmt.Errorf("Unknown runtime %q", t.Runtime)
+	}
+	return r, nil
+}
+
+// getTask returns a copy of a task that the caller is free to change.
+func (w *Worker) getTask(id uuid.UUID) (*task.Task, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, ok := w.Db[id]
+	if !ok {
+		return nil, false
+	}
+	return t.Clone(), true
+}
+
+// putTask stores a copy of the task, so that the caller can keep changing
+// it.
+func (w *Worker) putTask(t *task.Task) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.saveTask(t.Clone())
+}
+
+func (w *Worker) saveTask(t *task.Task) {
+	w.Db[t.ID] = t
+	if err := w.Store.Put(t.ID.String(), *t); err != nil {
+		log.Printf("Error saving task %v: %v\n", t.ID, err)
+	}
+}
+
+// Reconcile compares the tasks the worker knows about with the containers
+// present in the runtime. Containers of running tasks are adopted, tasks whose
+// container is gone are marked Failed, and tasks that were accepted but never
+// started are queued to start again. When reap is true, containers labelled
+// as belonging to a cube task the worker has no record of are removed.
+// Reconcile must run before RunTasks is started.
+func (w *Worker) Reconcile(reap bool) error {
+	type found struct {
+		container task.TaskContainer
+		lister    task.TaskLister
+	}
+
+	byTask := make(map[uuid.UUID]found)
+	for _, r := range w.allRuntimes() {
+		lister, ok := r.(task.TaskLister)
+		if !ok {
+			log.Printf("Runtime %T cannot list task containers, skipping it\n", r)
+			continue
+		}
+
+		containers, err := lister.ListTasks()
+		if err != nil {
+			return err
+		}
+		for _, c := range containers {
+			byTask[c.TaskID] = found{container: c, lister: lister}
+		}
+	}
+
+	for _, t := range w.GetTasks() {
+		id := t.ID
+		t = t.Clone()
+		f, ok := byTask[id]
+		c := f.container
+		delete(byTask, id)
+
+		switch t.FSM.Current() {
+		case task.Running:
+			if ok && isAlive(c.Status) {
+				log.Printf("Adopting container %v for task %v\n", c.ID, id)
+				t.ContainerId = c.ID
+			} else {
+				log.Printf("Container for running task %v is gone, marking it failed\n", id)
+				w.Ports.Release(id)
+				t.FSM.Event(context.Background(), task.Fail)
+			}
+		case task.Scheduled:
+			if ok && isAlive(c.Status) {
+				log.Printf("Adopting container %v for scheduled task %v\n", c.ID, id)
+				t.ContainerId = c.ID
+				t.FSM.Event(context.Background(), task.Start)
+			} else {
+				log.Printf("Requeueing scheduled task %v\n", id)
+				w.AddTask(&task.TaskEvent{
+					ID:         uuid.New(),
+					Action:     task.Start,
+					Timestatmp: time.Now(),
+					Task:       *t,
+				})
+			}
+		}
+		w.putTask(t)
+	}
+
+	for id, f := range byTask {
+		c := f.container
+		if !reap {
+			log.Printf("Found container %v for unknown task %v\n", c.ID, id)
+			continue
+		}
+		log.Printf("Reaping container %v for unknown task %v\n", c.ID, id)
+		if result := f.lister.Remove(c.ID); result.Error != nil {
+			log.Printf("Error reaping container %v: %v\n", c.ID, result.Error)
+		}
+	}
+
+	return nil
+}
+
+func isAlive(state string) bool {
+	switch state {
+	case "running", "restarting", "paused":
+		return true
+	}
+	return false
 }
 
 func (w *Worker) CollectState() {
 	for {
 		log.Println("Collecting stats")
-		w.Stats = GetStats()
-		w.TaskCount = w.Stats.TaskCount
-		time.Sleep(15 * time.Second)
+		stats := GetStats()
+		stats.TaskCount = w.runningTaskCount()
+		w.mu.Lock()
+		w.Stats = stats
+		w.TaskCount = stats.TaskCount
+		w.mu.Unlock()
+		time.Sleep(w.Intervals.Stats)
 	}
 }
 
+// currentStats returns the stats last collected, or nil if none were
+// collected yet.
+func (w *Worker) currentStats() *Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Stats
+}
+
+func (w *Worker) runningTaskCount() int {
+	count := 0
+	for _, t := range w.GetTasks() {
+		if t.FSM.Current() == task.Running {
+			count++
+		}
+	}
+	return count
+}
+
 func (w *Worker) AddTask(te *task.TaskEvent) {
-	w.Queue.Enqueue(te)
+	w.Queue.Add(te)
+}
+
+// AllocatePorts gives a new task, or a finished one that is started again,
+// the host ports it asks for, recording them in its HostPorts so they can
+// be reported back before the task starts.
+func (w *Worker) AllocatePorts(t *task.Task) error {
+	if cur, ok := w.getTask(t.ID); (ok && !finished(cur)) || len(t.PortBindings) == 0 {
+		return nil
+	}
+
+	ports, err := w.Ports.Allocate(t)
+	if err != nil {
+		return err
+	}
+	t.HostPorts = ports
+	return nil
 }
 
-func (w *Worker) runTask() task.DockerResult {
-	te := w.Queue.Dequeue()
-	if te == nil {
-		log.Println("No tasks in the queue")
-		return task.DockerResult{Error: nil}
+// PrepareStart readies the worker for a Start of t before the event is
+// queued. Besides allocating its ports, a task the worker has already
+// finished, e.g. one the manager moved back after losing its worker for a
+// while, starts over as a new run: the container of the last run is
+// removed and the task is Scheduled again, so that it is not reported as
+// finished while the Start is queued.
+func (w *Worker) PrepareStart(t *task.Task) error {
+	if err := w.AllocatePorts(t); err != nil {
+		return err
 	}
 
-	taskEventQueued := te.(*task.TaskEvent)
+	cur, ok := w.getTask(t.ID)
+	if !ok || !finished(cur) {
+		return nil
+	}
+	// Stopped tasks had their container removed already; that of a
+	// failed one may still be around.
+	if cur.FSM.Current() == task.Failed && cur.ContainerId != "" {
+		r, _ := w.runtimeFor(cur)
+		if lister, ok := r.(task.TaskLister); ok {
+			if result := lister.Remove(cur.ContainerId); result.Error != nil {
+				log.Printf("Error removing container %v of the last run of task %v: %v\n",
+					cur.ContainerId, t.ID, result.Error)
+			}
+		}
+	}
+	log.Printf("Starting finished task %v as a new run\n", t.ID)
+	next := t.Clone()
+	next.FSM = task.NewFSM()
+	next.FSM.SetState(task.Scheduled)
+	w.putTask(next)
+	return nil
+}
+
+// finished reports whether the worker is done with a task.
+func finished(t *task.Task) bool {
+	state := t.FSM.Current()
+	return state == task.Completed || state == task.Failed
+}
 
-	taskPersisted := w.Db[taskEventQueued.Task.ID]
+func (w *Worker) runTask(taskEventQueued *task.TaskEvent) task.RuntimeResult {
+	taskPersisted, _ := w.getTask(taskEventQueued.Task.ID)
+	if taskEventQueued.Action == syncAction {
+		if taskPersisted == nil {
+			return task.RuntimeResult{}
+		}
+		return w.syncTask(taskPersisted, &taskEventQueued.Task)
+	}
 	if taskPersisted == nil {
-		taskPersisted = &taskEventQueued.Task
-		w.Db[taskEventQueued.Task.ID] = &taskEventQueued.Task
+		// A task the worker has not seen before has been scheduled onto
+		// it by the manager, whatever state the manager sent along.
+		taskPersisted = taskEventQueued.Task.Clone()
+		taskPersisted.FSM = task.NewFSM()
+		taskPersisted.FSM.SetState(task.Scheduled)
+		w.putTask(taskPersisted)
 	}
 
-	var result task.DockerResult
+	var result task.RuntimeResult
 	if taskPersisted.FSM.Can(taskEventQueued.Action) {
 		switch taskEventQueued.Action {
 		case task.Start:
-			result = w.StartTask(&taskEventQueued.Task)
+			result = w.StartTask(taskPersisted)
 		case task.Stop:
-			result = w.StopTask(&taskEventQueued.Task)
+			result = w.StopTask(taskPersisted)
 		case task.Restart:
-			result = w.RestartTask(&taskEventQueued.Task)
+			result = w.RestartTask(taskPersisted)
 		default:
 			result.Error = errors.New("We choud not get here")
 		}
@@ -66,121 +393,136 @@ func (w *Worker) runTask() task.DockerResult {
 		result.Error = err
 	}
 
-	if result.Error == nil {
-		if err := taskPersisted.FSM.Event(context.Background(), taskEventQueued.Action); err != nil {
-			result.Error = err
-		}
-	}
-
 	return result
 }
 
+// RunTasks handles queued task events as they arrive, running up to
+// Concurrency of them at once. It returns when the queue is closed.
 func (w *Worker) RunTasks() {
-	for {
-		if w.Queue.Len() != 0 {
-			result := w.runTask()
-			if result.Error != nil {
-				log.Printf("Error running task: %v\n", result.Error)
+	n := w.Concurrency
+	if n < 1 {
+		n = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				te, ok := w.Queue.Get()
+				if !ok {
+					return
+				}
+				result := w.runTask(te)
+				if result.Error != nil {
+					log.Printf("Error running task: %v\n", result.Error)
+				}
+				w.Queue.Done(te)
 			}
-		} else {
-			log.Printf("No tasks to process currently\n")
-		}
-		time.Sleep(10 * time.Second)
+		}()
 	}
+	wg.Wait()
 }
 
-func (w *Worker) StartTask(t *task.Task) task.DockerResult {
+func (w *Worker) StartTask(t *task.Task) task.RuntimeResult {
 	t.StartTime = time.Now().UTC()
-	config := task.NewConfig(t)
-	d, err := task.NewDocker(config)
+	resetStatus(t)
+	r, err := w.runtimeFor(t)
 	if err != nil {
 		log.Printf("Error preparing for runnig task %v: %v\n", t.ID, err)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
-		return task.DockerResult{
+		t.Error = err.Error()
+		w.failTask(t)
+		return task.RuntimeResult{
 			Error: err,
 		}
 	}
 
-	result := d.Run()
+	result := r.Run(*task.NewConfig(t))
 	if result.Error != nil {
 		log.Printf("Error running task %v: %v\n", t.ID, result.Error)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
+		t.Error = result.Error.Error()
+		w.failTask(t)
 		return result
 	}
 
 	t.ContainerId = result.ContainerId
 	if err := t.FSM.Event(context.Background(), task.Start); err != nil {
-		return task.DockerResult{
+		return task.RuntimeResult{
 			Error: err,
 		}
 	}
-	w.Db[t.ID] = t
+	w.putTask(t)
 
 	return result
 }
 
-func (w *Worker) StopTask(t *task.Task) task.DockerResult {
-	config := task.NewConfig(t)
-	d, err := task.NewDocker(config)
+func (w *Worker) StopTask(t *task.Task) task.RuntimeResult {
+	r, err := w.runtimeFor(t)
 	if err != nil {
-		log.Printf("Error preparing for runnig task %v: %v\n", t.ID, err)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
-		return task.DockerResult{
+		return task.RuntimeResult{
 			Error: err,
 		}
 	}
 
-	result := d.Stop(t.ContainerId)
+	result := r.Stop(t.ContainerId)
 	if result.Error != nil {
 		log.Printf("Error stopping container %v: %v\n", t.ContainerId, result.Error)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
+		t.Error = result.Error.Error()
+		w.failTask(t)
 		return result
 	}
 	t.FinishTime = time.Now().UTC()
+	w.Ports.Release(t.ID)
 	t.FSM.Event(context.Background(), task.Stop)
-	w.Db[t.ID] = t
+	w.putTask(t)
 	log.Printf("Stopped and removed container %v for task %v", t.ContainerId, t.ID)
 
 	return result
 }
 
-func (w *Worker) RestartTask(t *task.Task) task.DockerResult {
+func (w *Worker) RestartTask(t *task.Task) task.RuntimeResult {
 	t.StartTime = time.Now().UTC()
-	config := task.NewConfig(t)
-	d, err := task.NewDocker(config)
+	resetStatus(t)
+	r, err := w.runtimeFor(t)
 	if err != nil {
-		log.Printf("Error preparing for runnig task %v: %v\n", t.ID, err)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
-		return task.DockerResult{
+		return task.RuntimeResult{
 			Error: err,
 		}
 	}
 
-	result := d.Restart(t.ContainerId)
+	// A task that failed gave up its ports, and the container needs them
+	// back.
+	if err := w.Ports.Claim(t.ID, t.AllocatedHostPorts()); err != nil {
+		log.Printf("Error restarting task %v: %v\n", t.ID, err)
+		t.Error = err.Error()
+		w.failTask(t)
+		return task.RuntimeResult{Error: err}
+	}
+
+	result := r.Restart(t.ContainerId)
 	if result.Error != nil {
 		log.Printf("Error running task %v: %v\n", t.ID, result.Error)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
+		t.Error = result.Error.Error()
+		w.failTask(t)
 		return result
 	}
 
 	t.ContainerId = result.ContainerId
 	if err := t.FSM.Event(context.Background(), task.Restart); err != nil {
-		return task.DockerResult{
+		return task.RuntimeResult{
 			Error: err,
 		}
 	}
-	w.Db[t.ID] = t
+	w.putTask(t)
 
 	return result
 }
 
+// GetTasks returns the tasks of the worker. They must not be changed.
 func (w *Worker) GetTasks() []*task.Task {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	tasks := []*task.Task{}
 	for _, t := range w.Db {
 		tasks = append(tasks, t)
@@ -188,50 +530,252 @@ func (w *Worker) GetTasks() []*task.Task {
 	return tasks
 }
 
-func (w *Worker) InspectTask(t *task.Task) task.DockerInspectResponse {
-	config := task.NewConfig(t)
-	d, err := task.NewDocker(config)
+var ErrTaskNotFound = errors.New("task not found")
+
+// TaskLogs returns the output of a task's container. The caller has to
+// close it, which also ends a followed stream.
+func (w *Worker) TaskLogs(id uuid.UUID, opts task.LogOptions) (io.ReadCloser, error) {
+	t, ok := w.getTask(id)
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if t.ContainerId == "" {
+		return nil, fmt.Errorf("Task %v has no container", id)
+	}
+
+	r, err := w.runtimeFor(t)
 	if err != nil {
-		log.Printf("Error preparing for runnig task %v: %v\n", t.ID, err)
-		t.FSM.Event(context.Background(), task.Fail)
-		w.Db[t.ID] = t
-		return task.DockerInspectResponse{
-			Error: err,
-		}
+		return nil, err
+	}
+	return r.Logs(t.ContainerId, opts)
+}
+
+func (w *Worker) InspectTask(t *task.Task) task.InspectResponse {
+	r, err := w.runtimeFor(t)
+	if err != nil {
+		return task.InspectResponse{Error: err}
 	}
 
-	return d.Inspect(t.ContainerId)
+	return r.Inspect(t.ContainerId)
+}
+
+// resetStatus clears what was recorded about how the task's container
+// last ran and why it ended.
+func resetStatus(t *task.Task) {
+	t.ExitCode = 0
+	t.OOMKilled = false
+	t.Health = ""
+	t.Error = ""
+	t.Output = nil
 }
 
+// UpdateTasks periodically checks on running tasks whose runtime does not
+// report container events, and every Intervals.Resync on all running
+// tasks in case events were missed.
 func (w *Worker) UpdateTasks() {
+	lastResync := time.Now()
 	for {
+		resync := time.Since(lastResync) >= w.Intervals.Resync
+		if resync {
+			lastResync = time.Now()
+		}
 		log.Println("Checking status of tasks")
-		w.updateTasks()
+		w.updateTasks(resync)
 		log.Println("Task updates completed")
-		time.Sleep(15 * time.Second)
+		time.Sleep(w.Intervals.Update)
 	}
 }
 
-func (w *Worker) updateTasks() {
-	for id, t := range w.Db {
-		if t.FSM.Current() == task.Running {
-			resp := w.InspectTask(t)
-			if resp.Error != nil {
-				log.Printf("Error inspecting for state of task %s: %v\n", id, resp.Error)
-			}
+// updateTasks queues a sync of every running task, or when all is false,
+// of those whose container events are not being followed.
+func (w *Worker) updateTasks(all bool) {
+	for _, t := range w.GetTasks() {
+		if t.FSM.Current() != task.Running {
+			continue
+		}
+		if !all && w.followsEvents(t) {
+			continue
+		}
+		w.queueSync(t.ID, task.Task{ContainerId: t.ContainerId})
+	}
+}
 
-			if resp.Container == nil {
-				log.Printf("No container for running task %s\n", id)
-				w.Db[id].FSM.Event(context.Background(), task.Fail)
-			}
+func (w *Worker) followsEvents(t *task.Task) bool {
+	r, err := w.runtimeFor(t)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watching[r]
+}
+
+// queueSync queues a sync of a task. reported holds what is known about
+// its container from an event: ContainerId, and ExitCode or OOMKilled if
+// the event said so.
+func (w *Worker) queueSync(id uuid.UUID, reported task.Task) {
+	reported.ID = id
+	w.AddTask(&task.TaskEvent{
+		ID:         uuid.New(),
+		Action:     syncAction,
+		Timestatmp: time.Now(),
+		Task:       reported,
+	})
+}
+
+// syncTask brings a running task up to date with its container. The task
+// fails once its container has exited or is gone, recording the exit code,
+// whether the container was killed for running out of memory and the last
+// lines of its output. reported is what the event that queued the sync
+// said, which is all there is to go on once the container has been removed.
+func (w *Worker) syncTask(t *task.Task, reported *task.Task) task.RuntimeResult {
+	if t.FSM.Current() != task.Running || t.ContainerId != reported.ContainerId {
+		return task.RuntimeResult{}
+	}
+
+	resp := w.InspectTask(t)
+	if resp.Error != nil {
+		log.Printf("Error inspecting for state of task %s: %v\n", t.ID, resp.Error)
+	}
+
+	state := resp.State
+	if state == nil {
+		log.Printf("No container for running task %s\n", t.ID)
+		if reported.ExitCode != 0 {
+			t.ExitCode = reported.ExitCode
+		}
+		t.OOMKilled = t.OOMKilled || reported.OOMKilled
+		t.Error = "Container is gone"
+		w.failTask(t)
+		return task.RuntimeResult{}
+	}
+
+	if len(state.HostPorts) > 0 {
+		t.HostPorts = state.HostPorts
+	}
+	t.Health = state.Health
+	t.OOMKilled = t.OOMKilled || state.OOMKilled || reported.OOMKilled
+	if state.Status == "exited" || state.Status == "dead" {
+		log.Printf("Container for task %s in not-running state %s, exit code %d\n", t.ID,
+			state.Status, state.ExitCode)
+		t.ExitCode = state.ExitCode
+		t.Error = fmt.Sprintf("Container exited with code %d", t.ExitCode)
+		if t.OOMKilled {
+			t.Error += " after running out of memory"
+		}
+		t.Output = w.lastOutput(t)
+		w.failTask(t)
+		return task.RuntimeResult{}
+	}
+	w.putTask(t)
+
+	return task.RuntimeResult{}
+}
+
+// lastOutput returns the last outputLines lines the task's container wrote.
+func (w *Worker) lastOutput(t *task.Task) []string {
+	r, err := w.runtimeFor(t)
+	if err != nil {
+		return nil
+	}
+	logs, err := r.Logs(t.ContainerId, task.LogOptions{Tail: outputLines})
+	if err != nil {
+		log.Printf("Error getting output of task %s: %v\n", t.ID, err)
+		return nil
+	}
+	defer logs.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > outputLines {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
 
-			if resp.Container.State.Status == "exited" {
-				log.Printf("Container for task %s in not-running state %s\n", id,
-					resp.Container.State.Status)
-				w.Db[id].FSM.Event(context.Background(), task.Fail)
+// failTask marks a task Failed. Its host ports are released, as the
+// manager no longer counts them as used and may place other tasks on them.
+func (w *Worker) failTask(t *task.Task) {
+	t.FinishTime = time.Now().UTC()
+	w.Ports.Release(t.ID)
+	t.FSM.Event(context.Background(), task.Fail)
+	w.putTask(t)
+}
+
+// WatchEvents follows the container events of the runtimes that report
+// them and syncs the tasks they concern right away. A broken event stream
+// is opened again, and all tasks are synced to catch up on the events
+// missed in the meantime. It only returns if no runtime reports events.
+func (w *Worker) WatchEvents() {
+	var wg sync.WaitGroup
+	for _, r := range w.allRuntimes() {
+		watcher, ok := r.(task.EventWatcher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(r task.Runtime) {
+			defer wg.Done()
+			for {
+				err := w.watchEvents(r, watcher)
+				log.Printf("Lost container events of runtime %T: %v\n", r, err)
+				time.Sleep(eventRetryInterval)
 			}
+		}(r)
+	}
+	wg.Wait()
+}
 
-			w.Db[id].HostPorts = resp.Container.NetworkSettings.NetworkSettingsBase.Ports
+func (w *Worker) watchEvents(r task.Runtime, watcher task.EventWatcher) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := watcher.WatchEvents(ctx)
+
+	w.setWatching(r, true)
+	defer w.setWatching(r, false)
+	w.updateTasks(true)
+
+	for {
+		select {
+		case e := <-events:
+			w.handleEvent(e)
+		case err := <-errs:
+			return err
 		}
 	}
 }
+
+func (w *Worker) setWatching(r task.Runtime, watching bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watching[r] = watching
+}
+
+func (w *Worker) handleEvent(e task.ContainerEvent) {
+	t, ok := w.getTask(e.TaskID)
+	if !ok {
+		return
+	}
+	// A task that is still being started has no container ID yet; its
+	// sync runs once the start is done.
+	if t.ContainerId != "" && t.ContainerId != e.ContainerId {
+		return
+	}
+	action := e.Action
+	if e.Health != "" {
+		action += ": " + e.Health
+	}
+	log.Printf("Container %v of task %v: %s\n", e.ContainerId, e.TaskID, action)
+
+	reported := task.Task{ContainerId: e.ContainerId}
+	switch e.Action {
+	case task.ContainerDied:
+		reported.ExitCode = e.ExitCode
+	case task.ContainerOOM:
+		reported.OOMKilled = true
+	}
+	w.queueSync(e.TaskID, reported)
+}
@@ -0,0 +1,274 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Yuya9786/cube/task"
+	"github.com/google/uuid"
+)
+
+func newTestWorker(t *testing.T) (*Worker, *task.Fake) {
+	t.Helper()
+	fake := task.NewFake()
+	w, err := New("test", fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, fake
+}
+
+func newTask(state string) *task.Task {
+	t := &task.Task{ID: uuid.New(), Name: "test", Image: "test"}
+	t.FSM = task.NewFSM()
+	t.FSM.SetState(state)
+	return t
+}
+
+func newEvent(action string, t task.Task) *task.TaskEvent {
+	return &task.TaskEvent{ID: uuid.New(), Action: action, Timestatmp: time.Now(), Task: t}
+}
+
+// mustGetTask returns the worker's task and checks that it is in state.
+func mustGetTask(t *testing.T, w *Worker, id uuid.UUID, state string) *task.Task {
+	t.Helper()
+	got, ok := w.getTask(id)
+	if !ok {
+		t.Fatalf("task %v not found", id)
+	}
+	if got.FSM.Current() != state {
+		t.Fatalf("task %v is %v, want %v (error %q)", id, got.FSM.Current(), state, got.Error)
+	}
+	return got
+}
+
+// startTask runs a new task on w and returns it once it is running.
+func startTask(t *testing.T, w *Worker) *task.Task {
+	t.Helper()
+	tk := newTask(task.Scheduled)
+	if result := w.runTask(newEvent(task.Start, *tk)); result.Error != nil {
+		t.Fatalf("starting task: %v", result.Error)
+	}
+	return mustGetTask(t, w, tk.ID, task.Running)
+}
+
+func TestStartTask(t *testing.T) {
+	w, fake := newTestWorker(t)
+
+	tk := startTask(t, w)
+	c, ok := fake.Containers[tk.ContainerId]
+	if !ok {
+		t.Fatalf("no container %v for task", tk.ContainerId)
+	}
+	if c.Config.Labels[task.TaskIDLabel] != tk.ID.String() {
+		t.Errorf("container labelled with task %q, want %v", c.Config.Labels[task.TaskIDLabel], tk.ID)
+	}
+	if tk.StartTime.IsZero() {
+		t.Error("start time not set")
+	}
+}
+
+func TestStartTaskFailure(t *testing.T) {
+	w, fake := newTestWorker(t)
+	fake.FailNext("start", errors.New("no such image"))
+
+	tk := newTask(task.Scheduled)
+	if result := w.runTask(newEvent(task.Start, *tk)); result.Error == nil {
+		t.Fatal("expected an error")
+	}
+	got := mustGetTask(t, w, tk.ID, task.Failed)
+	if got.Error != "no such image" {
+		t.Errorf("error is %q, want %q", got.Error, "no such image")
+	}
+	if got.FinishTime.IsZero() {
+		t.Error("finish time not set")
+	}
+	if len(fake.Containers) != 0 {
+		t.Errorf("%d containers left", len(fake.Containers))
+	}
+}
+
+func TestStopTask(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+
+	if result := w.runTask(newEvent(task.Stop, task.Task{ID: tk.ID})); result.Error != nil {
+		t.Fatalf("stopping task: %v", result.Error)
+	}
+	mustGetTask(t, w, tk.ID, task.Completed)
+	if _, ok := fake.Containers[tk.ContainerId]; ok {
+		t.Error("container not removed")
+	}
+}
+
+func TestStopTaskFailure(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.FailNext("stop", errors.New("device busy"))
+
+	if result := w.runTask(newEvent(task.Stop, task.Task{ID: tk.ID})); result.Error == nil {
+		t.Fatal("expected an error")
+	}
+	got := mustGetTask(t, w, tk.ID, task.Failed)
+	if got.Error != "device busy" {
+		t.Errorf("error is %q, want %q", got.Error, "device busy")
+	}
+}
+
+func TestTaskExit(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.Write(tk.ContainerId, "starting")
+	fake.Exit(tk.ContainerId, 3)
+
+	w.runTask(newEvent(syncAction, task.Task{ID: tk.ID, ContainerId: tk.ContainerId}))
+	got := mustGetTask(t, w, tk.ID, task.Failed)
+	if got.ExitCode != 3 {
+		t.Errorf("exit code is %d, want 3", got.ExitCode)
+	}
+	if got.Error != "Container exited with code 3" {
+		t.Errorf("error is %q", got.Error)
+	}
+	if len(got.Output) != 2 || got.Output[0] != "starting" {
+		t.Errorf("output is %q", got.Output)
+	}
+}
+
+func TestTaskContainerGone(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.Remove(tk.ContainerId)
+
+	w.runTask(newEvent(syncAction, task.Task{ID: tk.ID, ContainerId: tk.ContainerId, ExitCode: 137}))
+	got := mustGetTask(t, w, tk.ID, task.Failed)
+	if got.ExitCode != 137 {
+		t.Errorf("exit code is %d, want the reported 137", got.ExitCode)
+	}
+}
+
+func TestSyncIgnoresOtherContainer(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.Exit(tk.ContainerId, 1)
+
+	w.runTask(newEvent(syncAction, task.Task{ID: tk.ID, ContainerId: "old"}))
+	mustGetTask(t, w, tk.ID, task.Running)
+}
+
+func TestRestartTask(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.Exit(tk.ContainerId, 1)
+	w.runTask(newEvent(syncAction, task.Task{ID: tk.ID, ContainerId: tk.ContainerId}))
+	mustGetTask(t, w, tk.ID, task.Failed)
+
+	if result := w.runTask(newEvent(task.Restart, task.Task{ID: tk.ID})); result.Error != nil {
+		t.Fatalf("restarting task: %v", result.Error)
+	}
+	got := mustGetTask(t, w, tk.ID, task.Running)
+	if got.ExitCode != 0 || got.Error != "" || got.Output != nil {
+		t.Errorf("status of the last run kept: code %d, error %q, output %q", got.ExitCode, got.Error, got.Output)
+	}
+	if fake.Containers[tk.ContainerId].Status != "running" {
+		t.Error("container not running")
+	}
+}
+
+func TestRestartTaskFailure(t *testing.T) {
+	w, fake := newTestWorker(t)
+	tk := startTask(t, w)
+	fake.FailNext("restart", errors.New("no space left"))
+
+	if result := w.runTask(newEvent(task.Restart, task.Task{ID: tk.ID})); result.Error == nil {
+		t.Fatal("expected an error")
+	}
+	mustGetTask(t, w, tk.ID, task.Failed)
+}
+
+func TestFailedTaskPorts(t *testing.T) {
+	w, fake := newTestWorker(t)
+	w.Ports = NewPortAllocator(31000, 31999)
+
+	tk := newTask(task.Scheduled)
+	tk.PortBindings = map[string]string{"80/tcp": ""}
+	if err := w.AllocatePorts(tk); err != nil {
+		t.Fatal(err)
+	}
+	ports := tk.AllocatedHostPorts()
+	if len(ports) != 1 {
+		t.Fatalf("allocated ports %v, want one", ports)
+	}
+	port := ports[0]
+	w.runTask(newEvent(task.Start, *tk))
+	tk = mustGetTask(t, w, tk.ID, task.Running)
+
+	fake.Exit(tk.ContainerId, 1)
+	w.runTask(newEvent(syncAction, task.Task{ID: tk.ID, ContainerId: tk.ContainerId}))
+	mustGetTask(t, w, tk.ID, task.Failed)
+	if _, held := w.Ports.used[port]; held {
+		t.Errorf("port %d still held by the failed task", port)
+	}
+
+	w.runTask(newEvent(task.Restart, task.Task{ID: tk.ID}))
+	mustGetTask(t, w, tk.ID, task.Running)
+	if holder := w.Ports.used[port]; holder != tk.ID {
+		t.Errorf("port %d held by %v after restart, want %v", port, holder, tk.ID)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	w, fake := newTestWorker(t)
+
+	run := func(id uuid.UUID) string {
+		return fake.Run(task.Config{Labels: map[string]string{task.TaskIDLabel: id.String()}}).ContainerId
+	}
+
+	adopted := newTask(task.Running)
+	w.putTask(adopted)
+	adoptedContainer := run(adopted.ID)
+
+	gone := newTask(task.Running)
+	gone.ContainerId = "gone"
+	w.putTask(gone)
+
+	started := newTask(task.Scheduled)
+	w.putTask(started)
+	startedContainer := run(started.ID)
+
+	requeued := newTask(task.Scheduled)
+	w.putTask(requeued)
+
+	unknown := run(uuid.New())
+
+	if err := w.Reconcile(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mustGetTask(t, w, adopted.ID, task.Running); got.ContainerId != adoptedContainer {
+		t.Errorf("running task has container %q, want %q", got.ContainerId, adoptedContainer)
+	}
+	mustGetTask(t, w, gone.ID, task.Failed)
+	if got := mustGetTask(t, w, started.ID, task.Running); got.ContainerId != startedContainer {
+		t.Errorf("scheduled task has container %q, want %q", got.ContainerId, startedContainer)
+	}
+	mustGetTask(t, w, requeued.ID, task.Scheduled)
+	if w.Queue.Len() != 1 {
+		t.Errorf("%d events queued, want 1 to start the scheduled task", w.Queue.Len())
+	}
+	if _, ok := fake.Containers[unknown]; ok {
+		t.Error("container of unknown task not reaped")
+	}
+}
+
+func TestReconcileWithoutReap(t *testing.T) {
+	w, fake := newTestWorker(t)
+	unknown := fake.Run(task.Config{Labels: map[string]string{task.TaskIDLabel: uuid.NewString()}}).ContainerId
+
+	if err := w.Reconcile(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Containers[unknown]; !ok {
+		t.Error("container of unknown task removed")
+	}
+}
@@ -0,0 +1,94 @@
+// Package workqueue provides a FIFO queue of work items for a pool of
+// goroutines. Items are grouped by a key, and at most one item per key is
+// handed out at a time, so that work on the same thing is serialized while
+// work on different things runs concurrently.
+package workqueue
+
+import (
+	"sync"
+	"time"
+)
+
+type Queue[T any] struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []T
+	key    func(T) string
+	active map[string]bool
+	closed bool
+}
+
+// New creates a queue that groups items by the key function.
+func New[T any](key func(T) string) *Queue[T] {
+	q := &Queue[T]{
+		key:    key,
+		active: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add puts an item at the back of the queue.
+func (q *Queue[T]) Add(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, item)
+	q.cond.Signal()
+}
+
+// AddAfter puts an item at the back of the queue once d has passed.
+func (q *Queue[T]) AddAfter(item T, d time.Duration) {
+	time.AfterFunc(d, func() { q.Add(item) })
+}
+
+// Get blocks until there is an item whose key is not being worked on, marks
+// the key as being worked on and returns the item. Items with a busy key
+// are skipped, keeping their order. ok is false once the queue is closed.
+// Every item returned has to be handed back with Done.
+func (q *Queue[T]) Get() (item T, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return item, false
+		}
+		for i, it := range q.items {
+			k := q.key(it)
+			if q.active[k] {
+				continue
+			}
+			q.active[k] = true
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return it, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// Done marks the key of an item returned by Get as free again.
+func (q *Queue[T]) Done(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.active, q.key(item))
+	// Waiters may have skipped items with this key.
+	q.cond.Broadcast()
+}
+
+// Len returns the number of items waiting in the queue.
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close wakes up everything waiting in Get and drops the remaining items.
+func (q *Queue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+}
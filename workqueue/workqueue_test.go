@@ -0,0 +1,123 @@
+package workqueue
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// item is "key:value".
+type item string
+
+func newQueue() *Queue[item] {
+	return New(func(i item) string { return strings.Split(string(i), ":")[0] })
+}
+
+// get fails the test unless the queue hands out an item within a second.
+func get(t *testing.T, q *Queue[item]) item {
+	t.Helper()
+	got := make(chan item, 1)
+	go func() {
+		if i, ok := q.Get(); ok {
+			got <- i
+		}
+	}()
+	select {
+	case i := <-got:
+		return i
+	case <-time.After(time.Second):
+		t.Fatal("no item handed out")
+		return ""
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	q := newQueue()
+	for _, i := range []item{"a:1", "b:1", "c:1"} {
+		q.Add(i)
+	}
+	for _, want := range []item{"a:1", "b:1", "c:1"} {
+		if got := get(t, q); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d items left", q.Len())
+	}
+}
+
+func TestOneItemPerKey(t *testing.T) {
+	q := newQueue()
+	q.Add("a:1")
+	q.Add("a:2")
+	q.Add("b:1")
+
+	first := get(t, q)
+	if first != "a:1" {
+		t.Fatalf("got %q, want a:1", first)
+	}
+	// a:2 waits for a:1 to be done, b:1 does not.
+	if got := get(t, q); got != "b:1" {
+		t.Fatalf("got %q, want b:1", got)
+	}
+
+	got := make(chan item, 1)
+	go func() {
+		i, _ := q.Get()
+		got <- i
+	}()
+	select {
+	case i := <-got:
+		t.Fatalf("got %q while a:1 is still being worked on", i)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Done(first)
+	select {
+	case i := <-got:
+		if i != "a:2" {
+			t.Errorf("got %q, want a:2", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a:2 not handed out after a:1 was done")
+	}
+}
+
+func TestAddAfter(t *testing.T) {
+	q := newQueue()
+	q.AddAfter("a:1", 50*time.Millisecond)
+	if q.Len() != 0 {
+		t.Fatal("item added before the delay passed")
+	}
+	if got := get(t, q); got != "a:1" {
+		t.Errorf("got %q, want a:1", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	q := newQueue()
+	q.Add("a:1")
+	get(t, q)
+	q.Add("a:2")
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Get()
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("item handed out from a closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get still blocked after Close")
+	}
+
+	q.Add("b:1")
+	if q.Len() != 0 {
+		t.Errorf("%d items in a closed queue", q.Len())
+	}
+}